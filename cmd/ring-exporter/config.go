@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/exporter"
+	"os"
+)
+
+// effectiveConfig loads the config the way the other commands would see it,
+// but without ever writing to the file.
+func (g *globalOptions) effectiveConfig() (*exporter.Config, error) {
+	cfg, err := exporter.ReadConfig(g.configFile, g.loadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if g.loadOptions.ReadOnly {
+		exporter.EnsureReadOnlyConfigDefaults(cfg)
+	} else {
+		exporter.EnsureConfigDefaults(cfg)
+	}
+	if err = g.loadOptions.Overrides.Apply(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func handleConfigValidate(g *globalOptions) error {
+	cfg, err := g.effectiveConfig()
+	if err != nil {
+		return err
+	}
+
+	if err = exporter.ValidateConfig(cfg); err != nil {
+		return err
+	}
+	if err = exporter.ValidateWebConfigFile(g.configFile, cfg.WebConfig); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s is valid\n", g.configFile)
+	return nil
+}
+
+func handleConfigShow(g *globalOptions, effective bool) error {
+	var cfg *exporter.Config
+	var err error
+
+	if effective {
+		cfg, err = g.effectiveConfig()
+	} else {
+		cfg, err = exporter.ReadConfig(g.configFile, g.loadOptions)
+	}
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", " ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(exporter.RedactConfig(cfg))
+}
+
+func handleConfigConvert(g *globalOptions, src string, dst string, force bool) error {
+	cfg, err := exporter.ReadConfig(src, g.loadOptions)
+	if err != nil {
+		return err
+	}
+
+	if !force {
+		if _, err = os.Stat(dst); err == nil {
+			return fmt.Errorf("%s already exists. Use --force to overwrite it", dst)
+		}
+	}
+
+	if err = exporter.SaveConfig(dst, cfg); err != nil {
+		return err
+	}
+
+	fmt.Printf("Converted %s to %s\n", src, dst)
+	return nil
+}
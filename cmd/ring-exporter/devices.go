@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	ring_types "github.com/cheezypoofs/ring-exporter/ringapi/types"
+	"github.com/pkg/errors"
+	"os"
+	"text/tabwriter"
+)
+
+// deviceSummary is a device along with the interesting bits of its health.
+type deviceSummary struct {
+	Id          uint32   `json:"id"`
+	Type        string   `json:"type"`
+	Description string   `json:"description"`
+	Firmware    string   `json:"firmware,omitempty"`
+	Battery     *string  `json:"battery_pct"`
+	Signal      *float32 `json:"signal_dbm"`
+	WifiName    *string  `json:"wifi_name"`
+	Error       string   `json:"error,omitempty"`
+}
+
+func newDeviceSummary(id uint32, typ string, description string, health *ring_types.DeviceHealth, err error) deviceSummary {
+	summary := deviceSummary{
+		Id:          id,
+		Type:        typ,
+		Description: description,
+	}
+	if err != nil {
+		summary.Error = err.Error()
+		return summary
+	}
+	summary.Firmware = health.Firmware
+	summary.Battery = health.BatteryPercentage
+	summary.Signal = health.LatestSignalStrength
+	summary.WifiName = health.WifiName
+	return summary
+}
+
+func handleDevices(g *globalOptions, asJson bool) error {
+
+	session, err := openSession(g)
+	if err != nil {
+		return err
+	}
+
+	devices, err := session.GetDevices()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to retrieve device info")
+	}
+
+	summaries := []deviceSummary{}
+
+	for _, device := range devices.DoorBots {
+		var health *ring_types.DeviceHealth
+		hr, err := session.GetDoorBotHealth(&device)
+		if err == nil {
+			health = &hr.DeviceHealth
+		}
+		summaries = append(summaries, newDeviceSummary(device.Id, "doorbot", device.Description, health, err))
+	}
+
+	for _, device := range devices.Chimes {
+		var health *ring_types.DeviceHealth
+		cr, err := session.GetChimeHealth(&device)
+		if err == nil {
+			health = &cr.DeviceHealth
+		}
+		summaries = append(summaries, newDeviceSummary(device.Id, "chime", device.Description, health, err))
+	}
+
+	if asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		return encoder.Encode(summaries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tDESCRIPTION\tFIRMWARE\tBATTERY\tSIGNAL\tWIFI\tHEALTH")
+	for _, s := range summaries {
+		health := "ok"
+		if s.Error != "" {
+			health = "error: " + s.Error
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Id, s.Type, s.Description, orDash(s.Firmware), orDash(deref(s.Battery)), formatSignal(s.Signal), orDash(deref(s.WifiName)), health)
+	}
+	return w.Flush()
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatSignal(f *float32) string {
+	if f == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f", *f)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/exporter"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"os"
+	"time"
+)
+
+const (
+	doctorPass = "PASS"
+	doctorWarn = "WARN"
+	doctorFail = "FAIL"
+)
+
+// doctorReport accumulates and prints the results of each diagnostic check.
+type doctorReport struct {
+	failures int
+}
+
+func (r *doctorReport) result(status string, check string, detail string, hint string) {
+	fmt.Printf("[%s] %s: %s\n", status, check, detail)
+	if hint != "" && status != doctorPass {
+		fmt.Printf("       hint: %s\n", hint)
+	}
+	if status == doctorFail {
+		r.failures++
+	}
+}
+
+func (r *doctorReport) pass(check string, detail string) {
+	r.result(doctorPass, check, detail, "")
+}
+
+func (r *doctorReport) warn(check string, detail string, hint string) {
+	r.result(doctorWarn, check, detail, hint)
+}
+
+func (r *doctorReport) fail(check string, detail string, hint string) {
+	r.result(doctorFail, check, detail, hint)
+}
+
+func handleDoctor(g *globalOptions) error {
+	report := &doctorReport{}
+
+	cfg := checkConfig(report, g)
+
+	var stateHandler *exporter.RingStateHandler
+	if cfg != nil {
+		stateHandler = checkState(report, g, cfg)
+		checkPort(report, g, cfg)
+	}
+
+	connected := checkConnectivity(report)
+
+	if stateHandler != nil && connected {
+		checkDevices(report, cfg, stateHandler)
+	}
+
+	if report.failures > 0 {
+		return fmt.Errorf("%d check(s) failed", report.failures)
+	}
+	fmt.Println("All checks passed")
+	return nil
+}
+
+func checkConfig(report *doctorReport, g *globalOptions) *exporter.Config {
+	const check = "config file"
+	cfgFile := g.configFile
+
+	// Diagnosing the config mustn't migrate it, so the defaults are only applied in memory
+	cfg, err := g.effectiveConfig()
+	if err == nil {
+		err = exporter.ValidateConfig(cfg)
+	}
+	if err != nil {
+		report.fail(check, err.Error(), fmt.Sprintf("Run `init` to create %s or fix the error reported", cfgFile))
+		return nil
+	}
+	report.pass(check, fmt.Sprintf("%s parsed", cfgFile))
+
+	if cfg, err = cfg.ForAccount(g.account); err != nil {
+		report.fail("account", err.Error(), fmt.Sprintf("Run `init --account %s` to add it", g.account))
+		return nil
+	}
+
+	if g.loadOptions.ReadOnly {
+		report.pass("config writable", "not required in read-only mode")
+		return cfg
+	}
+
+	f, err := os.OpenFile(cfgFile, os.O_WRONLY, 0)
+	if err != nil {
+		report.warn("config writable", err.Error(), "The config file cannot be migrated forward with new defaults")
+	} else {
+		f.Close()
+		report.pass("config writable", cfgFile)
+	}
+
+	return cfg
+}
+
+// checkState returns the state if it holds a usable token.
+func checkState(report *doctorReport, g *globalOptions, cfg *exporter.Config) *exporter.RingStateHandler {
+	const check = "state"
+	const hint = "Run `init` to authorize a new token"
+
+	location := exporter.StatePath(g.configFile, cfg.StateConfig)
+	if location == "" {
+		location = cfg.StateConfig.Backend
+	}
+
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		report.fail(check, err.Error(), "Check state_config and the permissions of the state file")
+		return nil
+	}
+	report.pass(check, fmt.Sprintf("%s (%s)", location, cfg.StateConfig.Backend))
+
+	if cfg.StateConfig.Backend == exporter.MemoryStateBackend {
+		report.warn(check, "The memory backend forgets the token on exit", "Use the file or bolt backend")
+	}
+
+	token := stateHandler.FetchToken()
+	if token == nil || token.AccessToken == "" {
+		report.fail("token", "No token stored", hint)
+		return nil
+	}
+
+	hasRefresh := token.RefreshToken != ""
+	if !hasRefresh {
+		report.warn("refresh token", "No refresh token stored; the token cannot be renewed", hint)
+	} else {
+		report.pass("refresh token", "present")
+	}
+
+	switch {
+	case token.Expiry.IsZero():
+		report.pass("token expiry", "does not expire")
+	case token.Expiry.After(time.Now()):
+		report.pass("token expiry", fmt.Sprintf("expires %s", token.Expiry.Local().Format(time.RFC3339)))
+	case hasRefresh:
+		report.pass("token expiry", fmt.Sprintf("expired %s but will be refreshed", token.Expiry.Local().Format(time.RFC3339)))
+	default:
+		report.fail("token expiry", fmt.Sprintf("expired %s", token.Expiry.Local().Format(time.RFC3339)), hint)
+		return nil
+	}
+
+	return stateHandler
+}
+
+func checkPort(report *doctorReport, g *globalOptions, cfg *exporter.Config) {
+	const check = "metrics address"
+
+	l, err := exporter.Listen(g.configFile, cfg.WebConfig)
+	if err != nil {
+		report.fail(check, err.Error(), "Stop whatever is using the address (perhaps a running monitor) or change web_config.listen_address or web_config.port")
+		return
+	}
+	addr := l.Addr().String()
+	l.Close()
+	report.pass(check, fmt.Sprintf("%s is free", addr))
+}
+
+func checkConnectivity(report *doctorReport) bool {
+	const check = "api connectivity"
+
+	if err := ringapi.CheckConnectivity(10 * time.Second); err != nil {
+		report.fail(check, err.Error(), "Check network, DNS and proxy settings")
+		return false
+	}
+	report.pass(check, "reachable")
+	return true
+}
+
+func checkDevices(report *doctorReport, cfg *exporter.Config, stateHandler *exporter.RingStateHandler) {
+	session, err := ringapi.OpenAuthorizedSession(cfg.ApiConfig, stateHandler, nil)
+	if err != nil {
+		report.fail("session", err.Error(), "Run `init` to authorize a new token")
+		return
+	}
+
+	devices, err := session.GetDevices()
+	if err != nil {
+		report.fail("devices", err.Error(), "The token may have been revoked. Run `init` to authorize a new token")
+		return
+	}
+
+	if len(devices.DoorBots)+len(devices.Chimes) == 0 {
+		report.warn("devices", "No devices found", "Make sure the account has devices shared with it")
+		return
+	}
+	report.pass("devices", fmt.Sprintf("%d doorbot(s), %d chime(s)", len(devices.DoorBots), len(devices.Chimes)))
+
+	const hint = "The device may be offline or not reporting health"
+
+	for _, device := range devices.DoorBots {
+		check := fmt.Sprintf("health of %s", device.Description)
+		if _, err := session.GetDoorBotHealth(&device); err != nil {
+			report.fail(check, err.Error(), hint)
+		} else {
+			report.pass(check, "ok")
+		}
+	}
+
+	for _, device := range devices.Chimes {
+		check := fmt.Sprintf("health of %s", device.Description)
+		if _, err := session.GetChimeHealth(&device); err != nil {
+			report.fail(check, err.Error(), hint)
+		} else {
+			report.pass(check, "ok")
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/exporter"
+	"github.com/pkg/errors"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+type historyOptions struct {
+	device string
+	since  time.Duration
+	kind   string
+	format string
+}
+
+// historyEvent is a flattened ding along with the device it came from.
+type historyEvent struct {
+	DeviceId          uint32    `json:"device_id"`
+	DeviceDescription string    `json:"device_description"`
+	Id                int64     `json:"id"`
+	CreatedAt         time.Time `json:"created_at"`
+	Kind              string    `json:"kind"`
+}
+
+func handleHistory(g *globalOptions, opts historyOptions) error {
+
+	session, err := openSession(g)
+	if err != nil {
+		return err
+	}
+
+	devices, err := session.GetDevices()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to retrieve device info")
+	}
+
+	since := time.Now().Add(-opts.since)
+
+	var events []historyEvent
+	found := false
+
+	for _, device := range devices.DoorBots {
+		if !exporter.MatchesDevice(opts.device, device.Id, device.Description) {
+			continue
+		}
+		found = true
+
+		dings, err := session.GetDoorBotHistorySince(&device, since)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retrieve history for %s", device.Description)
+		}
+
+		for _, ding := range dings {
+			if opts.kind != "" && ding.Kind != opts.kind {
+				continue
+			}
+			ts, err := time.Parse(time.RFC3339, ding.CreatedAt)
+			if err != nil {
+				continue
+			}
+			events = append(events, historyEvent{
+				DeviceId:          device.Id,
+				DeviceDescription: device.Description,
+				Id:                ding.Id,
+				CreatedAt:         ts,
+				Kind:              ding.Kind,
+			})
+		}
+	}
+
+	if !found && opts.device != "" {
+		return fmt.Errorf("No device matching '%s'", opts.device)
+	}
+
+	// Newest first across all devices
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+
+	return printHistory(events, opts.format)
+}
+
+func printHistory(events []historyEvent, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", " ")
+		if events == nil {
+			events = []historyEvent{}
+		}
+		return encoder.Encode(events)
+
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"device_id", "device_description", "id", "created_at", "kind"})
+		for _, e := range events {
+			w.Write([]string{
+				strconv.FormatUint(uint64(e.DeviceId), 10),
+				e.DeviceDescription,
+				strconv.FormatInt(e.Id, 10),
+				e.CreatedAt.Format(time.RFC3339),
+				e.Kind,
+			})
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tDEVICE\tKIND\tID")
+		for _, e := range events {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", e.CreatedAt.Local().Format(time.RFC3339), e.DeviceDescription, e.Kind, e.Id)
+		}
+		return w.Flush()
+	}
+}
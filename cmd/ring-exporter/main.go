@@ -1,55 +1,247 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/cheezypoofs/ring-exporter/exporter"
 	"github.com/cheezypoofs/ring-exporter/ringapi"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 )
 
+// globalOptions holds the flags common to all commands.
+type globalOptions struct {
+	configFile  string
+	loadOptions exporter.LoadOptions
+	// account selects which account the single-account commands work with
+	account string
+	// stateKey overrides the passphrase found by `exporter.ReadStateKey`
+	stateKey []byte
+
+	// states opened by the command to close on exit
+	states []*exporter.RingStateHandler
+}
+
+// loadConfig loads and validates the config file named by the options.
+func (g *globalOptions) loadConfig() (*exporter.Config, error) {
+	cfg, err := exporter.LoadConfigWithOptions(g.configFile, g.loadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err = exporter.ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadAccountConfig loads the config as seen by the selected account.
+func (g *globalOptions) loadAccountConfig() (*exporter.Config, error) {
+	cfg, err := g.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.ForAccount(g.account)
+}
+
+// openState opens the state configured in `cfg` and makes sure the config
+// has a hardware id. It is closed by `close`.
+func (g *globalOptions) openState(cfg *exporter.Config) (*exporter.RingStateHandler, error) {
+	key := g.stateKey
+	if key == nil {
+		var err error
+		if key, err = exporter.ReadStateKey(g.configFile, cfg.StateConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	stateHandler, err := exporter.OpenRingStateHandler(g.configFile, cfg, key)
+	if err != nil {
+		return nil, err
+	}
+	g.states = append(g.states, stateHandler)
+	return stateHandler, nil
+}
+
+// close releases anything opened on behalf of the command.
+func (g *globalOptions) close() {
+	for _, stateHandler := range g.states {
+		stateHandler.Close()
+	}
+	g.states = nil
+}
+
+// monitorOptions holds the flags specific to the monitor command.
+type monitorOptions struct {
+	watchInterval   time.Duration
+	shutdownTimeout time.Duration
+}
+
 //////////////
 // command handlers
 //////////////
 
-func handleInit(cfgFile string) error {
+// initOptions holds the flags specific to the init command.
+type initOptions struct {
+	encrypt        bool
+	authMethod     string
+	webAddr        string
+	webAllowRemote bool
+}
+
+func handleInit(g *globalOptions, opts initOptions) error {
+	cfgFile := g.configFile
 
-	cfg, err := exporter.LoadConfig(cfgFile)
+	cfg, err := g.loadConfig()
 	if err != nil {
+		// Only start over if there's no config at all. Anything else
+		// (like a typo in the file) must not clobber the user's config.
+		if !os.IsNotExist(errors.Cause(err)) {
+			return err
+		}
+
 		// Let's initialize a new config
 
 		cfg = &exporter.Config{}
 
+		if g.loadOptions.ReadOnly {
+			return fmt.Errorf("No config at %s and it can't be created in read-only mode", cfgFile)
+		}
+
 		if exporter.EnsureConfigDefaults(cfg) {
 			if err = exporter.SaveConfig(cfgFile, cfg); err != nil {
 				return err
 			}
 		}
+
+		if err = g.loadOptions.Overrides.Apply(cfg); err != nil {
+			return err
+		}
+	}
+
+	if cfg, err = accountForInit(g, cfg); err != nil {
+		return err
+	}
+
+	if opts.authMethod != "" {
+		cfg.AuthConfig.Method = opts.authMethod
+	}
+
+	var authenticator ringapi.Authenticator
+	var webAuthenticator *exporter.WebAuthenticator
+	if opts.webAddr != "" {
+		if webAuthenticator, err = exporter.NewWebAuthenticator(opts.webAddr, opts.webAllowRemote); err != nil {
+			return errors.Wrapf(err, "Failed to serve the init page")
+		}
+		authenticator = webAuthenticator
+	} else if authenticator, err = exporter.NewAuthenticator(cfgFile, cfg.AuthConfig); err != nil {
+		return err
+	}
+
+	if opts.encrypt {
+		key, err := exporter.ReadStateKey(cfgFile, cfg.StateConfig)
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			if key, err = promptPassphrase("Passphrase to encrypt the token with: ", true); err != nil {
+				return err
+			}
+			fmt.Printf("Provide the same passphrase with %s or state_config.key_file when running other commands\n", exporter.StateKeyEnv)
+		}
+		g.stateKey = key
+	}
+
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		return err
 	}
 
 	// Now, let's authenticate a new token
-	if _, err = ringapi.OpenAuthorizedSession(cfg.ApiConfig, exporter.NewRingStateHandler(cfgFile), &exporter.CliAuthenticator{}); err != nil {
+	_, err = ringapi.OpenAuthorizedSession(cfg.ApiConfig, stateHandler, authenticator)
+	if webAuthenticator != nil {
+		webAuthenticator.Finish(err)
+	}
+	if err != nil {
 		return errors.Wrapf(err, "Failed to authorize new token")
 	}
 
+	if opts.encrypt {
+		// An existing token is reused without being saved again, so it (and
+		// the backup) could still be plaintext. Save it the way `state rekey` does.
+		cipher, err := exporter.NewTokenCipher(g.stateKey)
+		if err != nil {
+			return err
+		}
+		if err = stateHandler.Rekey(cipher); err != nil {
+			return errors.Wrapf(err, "Failed to encrypt the stored token")
+		}
+	}
+
 	return nil
 }
 
-func handleTest(cfgFile string) error {
+// accountForInit returns the config as seen by the selected account, adding
+// the account to the config file first if it isn't there yet.
+func accountForInit(g *globalOptions, cfg *exporter.Config) (*exporter.Config, error) {
+	accountCfg, err := cfg.ForAccount(g.account)
+	if err == nil {
+		return accountCfg, nil
+	}
+
+	if g.loadOptions.ReadOnly {
+		return nil, errors.Wrapf(err, "The account can't be added in read-only mode")
+	}
 
-	cfg, err := exporter.LoadConfig(cfgFile)
+	// Add it to the file as it is, without defaults or overrides
+	fileCfg, err := exporter.ReadConfig(g.configFile, g.loadOptions)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	account := exporter.AccountConfig{Name: g.account}
+	exporter.EnsureAccountConfigDefaults(&account)
+	fileCfg.Accounts = append(fileCfg.Accounts, account)
+	if err = exporter.ValidateConfig(fileCfg); err != nil {
+		return nil, err
+	}
+	if err = exporter.SaveConfig(g.configFile, fileCfg); err != nil {
+		return nil, err
+	}
+	log.Printf("Added account %s to %s", g.account, g.configFile)
+
+	if cfg, err = g.loadConfig(); err != nil {
+		return nil, err
+	}
+	return cfg.ForAccount(g.account)
+}
+
+// openSession loads the config and opens a session with the stored token.
+func openSession(g *globalOptions) (*ringapi.AuthorizedSession, error) {
+
+	cfg, err := g.loadAccountConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	// No authenticator. Should fail if we don't have a token.
-	session, err := ringapi.OpenAuthorizedSession(cfg.ApiConfig, exporter.NewRingStateHandler(cfgFile), nil)
+	return ringapi.OpenAuthorizedSession(cfg.ApiConfig, stateHandler, nil)
+}
+
+func handleTest(g *globalOptions) error {
+
+	session, err := openSession(g)
 	if err != nil {
 		return err
 	}
@@ -65,57 +257,244 @@ func handleTest(cfgFile string) error {
 	return nil
 }
 
-func handleMonitor(cfgFile string, metrics *prometheus.Registry, quitter chan struct{}) error {
+func handleMonitor(g *globalOptions, opts monitorOptions, metrics *prometheus.Registry) error {
 
-	monitor, err := exporter.NewMonitor(cfgFile, metrics)
+	cfg, err := g.loadConfig()
 	if err != nil {
 		return err
 	}
 
-	monitor.PollOnce()
-	pollTicker := time.NewTicker(time.Duration(monitor.Config.PollIntervalSeconds) * time.Second)
-	saveTicker := time.NewTicker(time.Duration(monitor.Config.SaveIntervalSeconds) * time.Second)
+	// Don't poll for nothing if the metrics can't be served
+	if err = exporter.ValidateWebConfigFile(g.configFile, cfg.WebConfig); err != nil {
+		return err
+	}
+	listener, err := exporter.Listen(g.configFile, cfg.WebConfig)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	var accounts []*exporter.Account
+	for _, name := range cfg.AccountNames() {
+		accountCfg, err := cfg.ForAccount(name)
+		if err != nil {
+			return err
+		}
+
+		stateHandler, err := g.openState(accountCfg)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open state for account %s", name)
+		}
+
+		accounts = append(accounts, &exporter.Account{
+			Name:         name,
+			Config:       accountCfg,
+			StateHandler: stateHandler,
+		})
+	}
+
+	monitor, err := exporter.NewMonitor(g.configFile, cfg, accounts, metrics)
+	if err != nil {
+		return err
+	}
+
+	// Cancelling the context aborts any API calls in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	quitter := make(chan struct{})
+	done := make(chan struct{})
+
+	// Reload the config on SIGHUP or when the file changes
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(terminate)
+
+	var changed <-chan struct{}
+	if opts.watchInterval > 0 {
+		changed = exporter.WatchConfigFile(g.configFile, opts.watchInterval, quitter)
+	}
 
 	go func() {
+		defer close(done)
+
+		poll := func() {
+			if err := monitor.PollOnce(ctx); err != nil {
+				log.Printf("Poll failed: %v", err)
+			}
+		}
+
+		poll()
+		pollTicker := time.NewTicker(time.Duration(monitor.Config.PollIntervalSeconds) * time.Second)
+		saveTicker := time.NewTicker(time.Duration(monitor.Config.SaveIntervalSeconds) * time.Second)
+		defer pollTicker.Stop()
+		defer saveTicker.Stop()
+
+		reload := func() {
+			if err := monitor.Reload(g.loadConfig); err != nil {
+				log.Printf("Failed to reload config, keeping the current one: %v", err)
+				return
+			}
+			pollTicker.Reset(time.Duration(monitor.Config.PollIntervalSeconds) * time.Second)
+			saveTicker.Reset(time.Duration(monitor.Config.SaveIntervalSeconds) * time.Second)
+			log.Printf("Reloaded config from %s", g.configFile)
+		}
+
 		for {
 			select {
 			case <-pollTicker.C:
-				monitor.PollOnce()
+				poll()
 			case <-saveTicker.C:
-				monitor.StateHandler.Save()
+				monitor.Save()
+			case <-hup:
+				reload()
+			case <-changed:
+				reload()
 			case <-quitter:
-				pollTicker.Stop()
-				saveTicker.Stop()
 				return
 			}
 		}
 	}()
 
+	server := &http.Server{
+		Handler: monitor.Handler(metrics),
+	}
+	// Event streams never end by themselves
+	server.RegisterOnShutdown(monitor.CloseStreams)
+
+	serveErr := make(chan error, 1)
 	go func() {
-		http.Handle(monitor.Config.WebConfig.MetricsRoute, promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
-		http.ListenAndServe(fmt.Sprintf(":%d", monitor.Config.WebConfig.Port), nil)
+		serveErr <- exporter.Serve(listener, server, g.configFile, monitor.Config.WebConfig)
 	}()
+	log.Printf("Serving on %s", listener.Addr())
 
-	return nil
+	var failure error
+	select {
+	case sig := <-terminate:
+		log.Printf("Received %v, shutting down", sig)
+	case err := <-serveErr:
+		// Shut down as gracefully as we can, but exit with the error
+		failure = errors.Wrapf(err, "Failed to serve metrics")
+		log.Printf("%v, shutting down", failure)
+	}
+
+	// Stop the tickers and abort whatever poll or re-authentication is in flight,
+	// then wait for them to wind down
+	cancel()
+	close(quitter)
+	<-done
+	monitor.WaitReauthentications()
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), opts.shutdownTimeout)
+	defer shutdownCancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down the web server cleanly: %v", err)
+	}
+
+	// Don't lose anything counted (or a refreshed token) since the last save
+	if err := monitor.Save(); err == nil {
+		log.Printf("State saved. Goodbye")
+	}
+
+	return failure
 }
 
 ///////////////////////
 
 func main() {
 
-	cfg := struct {
-		configFile string
-	}{}
+	g := &globalOptions{}
 
 	a := kingpin.New(filepath.Base(os.Args[0]), "A Prometheus exporter for Ring devices")
 	a.HelpFlag.Short('h')
 
-	a.Command("init", "Initialize (or reinitialize) for background usage")
+	initOpts := initOptions{}
+	initCmd := a.Command("init", "Initialize (or reinitialize) for background usage")
+	initCmd.Flag("encrypt", fmt.Sprintf("Encrypt the token at rest. Prompts for a passphrase unless one is provided by %s or state_config.key_file", exporter.StateKeyEnv)).
+		BoolVar(&initOpts.encrypt)
+	initCmd.Flag("auth-method", "How to obtain the credentials and 2FA code. Defaults to auth_config.method").
+		EnumVar(&initOpts.authMethod, exporter.AuthMethods...)
+	initCmd.Flag("web", "Serve a page on this address (such as :8080, which listens on 127.0.0.1) to enter the credentials and 2FA code into instead").
+		StringVar(&initOpts.webAddr)
+	initCmd.Flag("web-allow-remote", "Allow --web to listen on a non-loopback address. The credentials are sent over plain HTTP").
+		BoolVar(&initOpts.webAllowRemote)
 	a.Command("test", "Test the configuration and token")
-	a.Command("monitor", "Execute monitoring and exposition of metrics")
+	monitorOpts := monitorOptions{}
+	monitorCmd := a.Command("monitor", "Execute monitoring and exposition of metrics")
+	monitorCmd.Flag("config.watch-interval", "How often to check the configuration file for changes to reload. Zero disables watching (SIGHUP still reloads)").
+		Default("10s").DurationVar(&monitorOpts.watchInterval)
+	monitorCmd.Flag("web.shutdown-timeout", "How long to wait for in-flight scrapes when shutting down").
+		Default("10s").DurationVar(&monitorOpts.shutdownTimeout)
 
-	a.Flag("config.file", "JSON configuration file").
-		Default("ring-config.json").StringVar(&cfg.configFile)
+	a.Command("doctor", "Diagnose common configuration problems")
+
+	configCmd := a.Command("config", "Inspect and convert the configuration")
+	configCmd.Command("validate", "Check that the configuration file is valid")
+	var showEffective bool
+	configShowCmd := configCmd.Command("show", "Print the configuration with the hardware id redacted")
+	configShowCmd.Flag("effective", "Include defaults and flag/environment overrides that would be applied").
+		BoolVar(&showEffective)
+
+	convert := struct {
+		src   string
+		dst   string
+		force bool
+	}{}
+	configConvertCmd := configCmd.Command("convert", "Translate a configuration file to another format (by file extension)")
+	configConvertCmd.Arg("source", "Configuration file to read").
+		Required().StringVar(&convert.src)
+	configConvertCmd.Arg("destination", "Configuration file to write (.json, .yaml, .yml or .toml)").
+		Required().StringVar(&convert.dst)
+	configConvertCmd.Flag("force", "Overwrite the destination if it exists").
+		BoolVar(&convert.force)
+
+	tokenCmd := a.Command("token", "Inspect and revoke the token")
+	tokenCmd.Command("show", "Show the expiry and other details of the token without revealing it")
+	tokenCmd.Command("revoke", "Invalidate the session server-side and remove the token from the state")
+	a.Command("logout", "Like `token revoke`, but removes the token from the state even if the server can't be reached")
+
+	rekey := rekeyOptions{}
+	stateCmd := a.Command("state", "Manage the state")
+	stateRekeyCmd := stateCmd.Command("rekey", fmt.Sprintf("Re-encrypt the token with a new key. The current key comes from %s or state_config.key_file", exporter.StateKeyEnv))
+	stateRekeyCmd.Flag("new-key-file", "File holding the new passphrase. Prompts for it if not provided").
+		StringVar(&rekey.newKeyFile)
+	stateRekeyCmd.Flag("decrypt", "Store the token in plaintext instead").
+		BoolVar(&rekey.decrypt)
+
+	var devicesJson bool
+	devicesCmd := a.Command("devices", "List all devices along with their health")
+	devicesCmd.Flag("json", "Emit JSON instead of a table").
+		BoolVar(&devicesJson)
+
+	history := historyOptions{}
+	historyCmd := a.Command("history", "Dump the event history of doorbots")
+	historyCmd.Flag("device", "Only show events for the device with this description or id").
+		StringVar(&history.device)
+	historyCmd.Flag("since", "How far back in time to look").
+		Default("24h").DurationVar(&history.since)
+	historyCmd.Flag("kind", "Only show events of this kind (ding, motion, on_demand)").
+		StringVar(&history.kind)
+	historyCmd.Flag("format", "Output format").
+		Default("table").EnumVar(&history.format, "table", "json", "csv")
+
+	a.Flag("config.file", "Configuration file. The format (JSON, YAML or TOML) is picked by the extension").
+		Default("ring-config.json").StringVar(&g.configFile)
+	a.Flag("config.allow-unknown-fields", "Tolerate unrecognized keys in the configuration file").
+		BoolVar(&g.loadOptions.AllowUnknownFields)
+	a.Flag("account", "The account (from accounts in the configuration) to work with. `init` adds it if it's missing. `monitor` always watches all of them").
+		Default(exporter.DefaultAccount).StringVar(&g.account)
+	a.Flag("config.read-only", "Never write to the configuration file. Defaults are applied in memory and a missing hardware id is kept in the state file").
+		BoolVar(&g.loadOptions.ReadOnly)
+
+	// Every config item can be overridden with a flag or environment variable.
+	// Precedence is flag > env > file > default.
+	overrides := map[string]*string{}
+	for _, field := range exporter.OverrideFields {
+		overrides[field.Name] = a.Flag(field.Name, field.Help).Envar(field.Env).String()
+	}
 
 	parsed, err := a.Parse(os.Args[1:])
 	if err != nil {
@@ -124,24 +503,46 @@ func main() {
 		os.Exit(2)
 	}
 
-	quitter := make(chan struct{})
+	g.loadOptions.Overrides = exporter.ConfigOverrides{}
+	for name, value := range overrides {
+		g.loadOptions.Overrides[name] = *value
+	}
+
 	metrics := prometheus.NewRegistry()
 
 	switch parsed {
 	case "init":
-		err = handleInit(cfg.configFile)
+		err = handleInit(g, initOpts)
 	case "test":
-		err = handleTest(cfg.configFile)
+		err = handleTest(g)
+	case "config validate":
+		err = handleConfigValidate(g)
+	case "config show":
+		err = handleConfigShow(g, showEffective)
+	case "config convert":
+		err = handleConfigConvert(g, convert.src, convert.dst, convert.force)
+	case "token show":
+		err = handleTokenShow(g)
+	case "token revoke":
+		err = handleTokenRevoke(g)
+	case "logout":
+		err = handleLogout(g)
+	case "state rekey":
+		err = handleStateRekey(g, rekey)
+	case "doctor":
+		err = handleDoctor(g)
+	case "devices":
+		err = handleDevices(g, devicesJson)
+	case "history":
+		err = handleHistory(g, history)
 	case "monitor":
-		err = handleMonitor(cfg.configFile, metrics, quitter)
-
-		select {
-		case <-quitter:
-		}
+		err = handleMonitor(g, monitorOpts, metrics)
 	default:
 		err = fmt.Errorf("oops")
 	}
 
+	g.close()
+
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
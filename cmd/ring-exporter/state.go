@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/exporter"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// promptPassphrase reads a passphrase from the terminal, twice if `confirm`.
+func promptPassphrase(prompt string, confirm bool) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("The passphrase must not be empty")
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Confirm passphrase: ")
+		again, err := terminal.ReadPassword(int(syscall.Stdin))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(passphrase, again) {
+			return nil, fmt.Errorf("The passphrases do not match")
+		}
+	}
+
+	return passphrase, nil
+}
+
+type rekeyOptions struct {
+	newKeyFile string
+	decrypt    bool
+}
+
+func handleStateRekey(g *globalOptions, opts rekeyOptions) error {
+
+	cfg, err := g.loadAccountConfig()
+	if err != nil {
+		return err
+	}
+
+	// Opening the state decrypts it with the current key
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		return err
+	}
+
+	var cipher *exporter.TokenCipher
+	if !opts.decrypt {
+		var key []byte
+		if opts.newKeyFile != "" {
+			data, err := ioutil.ReadFile(opts.newKeyFile)
+			if err != nil {
+				return err
+			}
+			key = bytes.TrimSpace(data)
+		} else if key, err = promptPassphrase("New state passphrase: ", true); err != nil {
+			return err
+		}
+
+		if cipher, err = exporter.NewTokenCipher(key); err != nil {
+			return err
+		}
+	}
+
+	if err = stateHandler.Rekey(cipher); err != nil {
+		return err
+	}
+
+	if opts.decrypt {
+		fmt.Println("The token is now stored in plaintext. Remove the key from the environment and state_config.key_file")
+	} else {
+		fmt.Printf("The token is now encrypted with the new key. Update %s or state_config.key_file to match\n", exporter.StateKeyEnv)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s (%s ago)", t.Local().Format(time.RFC3339), time.Since(t).Round(time.Second))
+}
+
+func handleTokenShow(g *globalOptions) error {
+
+	cfg, err := g.loadAccountConfig()
+	if err != nil {
+		return err
+	}
+
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		return err
+	}
+
+	token := stateHandler.FetchToken()
+	if token == nil {
+		fmt.Println("No token stored. Run `init` to authorize one")
+		return nil
+	}
+
+	expiry := "never"
+	if !token.Expiry.IsZero() {
+		expiry = token.Expiry.Local().Format(time.RFC3339)
+		if token.Expiry.Before(time.Now()) {
+			expiry += " (expired)"
+		} else {
+			expiry += fmt.Sprintf(" (in %s)", time.Until(token.Expiry).Round(time.Second))
+		}
+	}
+
+	fmt.Printf("Type:          %s\n", token.Type())
+	fmt.Printf("Expires:       %s\n", expiry)
+	fmt.Printf("Refresh token: %t\n", token.RefreshToken != "")
+	fmt.Printf("Last updated:  %s\n", formatTime(stateHandler.TokenUpdatedAt()))
+	return nil
+}
+
+// revokeToken invalidates the session server-side and then forgets the token.
+// If `force`, the token is forgotten even if the server can't be told.
+func revokeToken(g *globalOptions, force bool) error {
+
+	cfg, err := g.loadAccountConfig()
+	if err != nil {
+		return err
+	}
+
+	stateHandler, err := g.openState(cfg)
+	if err != nil {
+		return err
+	}
+
+	if stateHandler.FetchToken() == nil {
+		fmt.Println("No token stored")
+		return nil
+	}
+
+	session, err := ringapi.OpenAuthorizedSession(cfg.ApiConfig, stateHandler, nil)
+	if err == nil {
+		err = session.DeleteSession()
+	}
+	if err != nil {
+		if !force {
+			return errors.Wrapf(err, "Failed to revoke the session. The token has been kept")
+		}
+		log.Printf("Failed to revoke the session, forgetting the token anyway: %v", err)
+	} else {
+		fmt.Println("Session revoked")
+	}
+
+	if err = stateHandler.ClearToken(); err != nil {
+		return err
+	}
+
+	fmt.Println("Token removed from the state. Run `init` to authorize a new one")
+	return nil
+}
+
+func handleTokenRevoke(g *globalOptions) error {
+	return revokeToken(g, false)
+}
+
+func handleLogout(g *globalOptions) error {
+	return revokeToken(g, true)
+}
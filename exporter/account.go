@@ -0,0 +1,111 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"regexp"
+)
+
+// DefaultAccount names the account configured at the top level of the config.
+const DefaultAccount = "default"
+
+// account names end up in state file names so keep them tame
+var accountNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// AccountConfig is an additional Ring account, with its own token and state,
+// monitored by the same process.
+type AccountConfig struct {
+	Name        string            `json:"name" yaml:"name" toml:"name"`
+	ApiConfig   ringapi.ApiConfig `json:"api_config" yaml:"api_config" toml:"api_config"`
+	StateConfig StateConfig       `json:"state_config" yaml:"state_config" toml:"state_config"`
+	AuthConfig  AuthConfig        `json:"auth_config" yaml:"auth_config" toml:"auth_config"`
+}
+
+// EnsureAccountConfigDefaults handles setting sane defaults
+// and migrating the config forward. It returns `true` if
+// any changes were made.
+func EnsureAccountConfigDefaults(config *AccountConfig) bool {
+	dirty := false
+	if config.StateConfig.Path == "" {
+		// Don't share the default account's state
+		switch config.StateConfig.Backend {
+		case "", FileStateBackend:
+			dirty = true
+			config.StateConfig.Path = fmt.Sprintf("ring-state-%s.json", config.Name)
+		case BoltStateBackend:
+			dirty = true
+			config.StateConfig.Path = fmt.Sprintf("ring-state-%s.db", config.Name)
+		}
+	}
+	if ringapi.EnsureApiConfigDefaults(&config.ApiConfig) {
+		dirty = true
+	}
+	if EnsureStateConfigDefaults(&config.StateConfig) {
+		dirty = true
+	}
+	if EnsureAuthConfigDefaults(&config.AuthConfig) {
+		dirty = true
+	}
+	return dirty
+}
+
+// AccountNames returns the names of all of the accounts, starting with the
+// default account.
+func (cfg *Config) AccountNames() []string {
+	names := []string{DefaultAccount}
+	for _, account := range cfg.Accounts {
+		names = append(names, account.Name)
+	}
+	return names
+}
+
+// ForAccount returns a copy of the config with the top-level api, state and
+// auth config replaced by those of the named account, so that it can be used
+// as if the account were the only one. An empty name is the default account.
+func (cfg *Config) ForAccount(name string) (*Config, error) {
+	if name == "" || name == DefaultAccount {
+		projected := *cfg
+		projected.Accounts = nil
+		return &projected, nil
+	}
+
+	for _, account := range cfg.Accounts {
+		if account.Name == name {
+			projected := *cfg
+			projected.ApiConfig = account.ApiConfig
+			projected.StateConfig = account.StateConfig
+			projected.AuthConfig = account.AuthConfig
+			projected.Accounts = nil
+			return &projected, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No account named '%s' in the config", name)
+}
+
+// validateAccounts adds any problems with the accounts to `problems`.
+func validateAccounts(cfg *Config, problems []string) []string {
+	names := map[string]bool{DefaultAccount: true}
+	paths := map[string]string{}
+	if cfg.StateConfig.Path != "" {
+		paths[cfg.StateConfig.Path] = DefaultAccount
+	}
+
+	for i, account := range cfg.Accounts {
+		if !accountNameRegexp.MatchString(account.Name) {
+			problems = append(problems, fmt.Sprintf("accounts[%d].name '%s' must be made of letters, digits, '-' and '_'", i, account.Name))
+		} else if names[account.Name] {
+			problems = append(problems, fmt.Sprintf("accounts[%d].name '%s' is already used", i, account.Name))
+		}
+		names[account.Name] = true
+
+		if account.StateConfig.Backend != MemoryStateBackend && account.StateConfig.Path != "" {
+			if other, ok := paths[account.StateConfig.Path]; ok {
+				problems = append(problems, fmt.Sprintf("accounts[%d].state_config.path '%s' is also used by account '%s'", i, account.StateConfig.Path, other))
+			}
+			paths[account.StateConfig.Path] = account.Name
+		}
+	}
+
+	return problems
+}
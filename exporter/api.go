@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	apiDevicesRoute = "/api/v1/devices"
+	apiEventsRoute  = "/api/v1/events"
+	apiStatusRoute  = "/api/v1/status"
+
+	// how far back /api/v1/events looks without `since`
+	defaultEventsSince = 24 * time.Hour
+)
+
+// apiEvent is a DingEvent along with the account it belongs to.
+type apiEvent struct {
+	Account string `json:"account"`
+	DingEvent
+}
+
+// AccountStatus is the outcome of the polls of an account.
+type AccountStatus struct {
+	Account     string     `json:"account"`
+	LastPoll    *time.Time `json:"last_poll,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	TokenValid  bool       `json:"token_valid"`
+	TokenExpiry *time.Time `json:"token_expiry,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// Status returns the status of the account as of the last poll.
+func (a *Account) Status() AccountStatus {
+	a.statusLock.Lock()
+	status := AccountStatus{
+		Account:     a.Name,
+		LastPoll:    optionalTime(a.lastPoll),
+		LastSuccess: optionalTime(a.lastSuccess),
+		LastError:   a.lastError,
+		TokenValid:  a.tokenValid,
+	}
+	a.statusLock.Unlock()
+
+	if token := a.StateHandler.FetchToken(); token != nil {
+		status.TokenExpiry = optionalTime(token.Expiry)
+	}
+	return status
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", " ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("Failed to write API response: %v", err)
+	}
+}
+
+// selectAccounts returns the accounts selected by the `account` parameter, which
+// defaults to all of them.
+func (m *Monitor) selectAccounts(w http.ResponseWriter, r *http.Request) ([]*Account, bool) {
+	name := r.URL.Query().Get("account")
+	if name == "" {
+		return m.Accounts, true
+	}
+	account := m.account(name)
+	if account == nil {
+		http.Error(w, fmt.Sprintf("Unknown account '%s'", name), http.StatusBadRequest)
+		return nil, false
+	}
+	return []*Account{account}, true
+}
+
+// parseSince accepts a timestamp (RFC 3339) or a duration to look back.
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now().Add(-defaultEventsSince), nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("since '%s' must be an RFC 3339 timestamp or a duration", value)
+	}
+	return t, nil
+}
+
+// handleApiDevices serves the devices as of the last poll.
+func (m *Monitor) handleApiDevices(w http.ResponseWriter, r *http.Request) {
+	accounts, ok := m.selectAccounts(w, r)
+	if !ok {
+		return
+	}
+
+	devices := []DeviceSnapshot{}
+	for _, account := range accounts {
+		devices = append(devices, account.Devices()...)
+	}
+
+	writeJson(w, struct {
+		Devices []DeviceSnapshot `json:"devices"`
+	}{devices})
+}
+
+// handleApiEvents serves the events kept in the state, newest first.
+func (m *Monitor) handleApiEvents(w http.ResponseWriter, r *http.Request) {
+	accounts, ok := m.selectAccounts(w, r)
+	if !ok {
+		return
+	}
+
+	since, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events := []apiEvent{}
+	for _, account := range accounts {
+		for _, event := range account.StateHandler.Events(since) {
+			events = append(events, apiEvent{account.Name, event})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].CreatedAt.After(events[j].CreatedAt)
+	})
+
+	writeJson(w, struct {
+		Events []apiEvent `json:"events"`
+	}{events})
+}
+
+// handleApiStatus serves the outcome of the polls.
+func (m *Monitor) handleApiStatus(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Ready    bool            `json:"ready"`
+		Accounts []AccountStatus `json:"accounts"`
+	}{
+		Ready: m.Ready() == nil,
+	}
+	for _, account := range m.Accounts {
+		status.Accounts = append(status.Accounts, account.Status())
+	}
+
+	writeJson(w, status)
+}
@@ -2,14 +2,26 @@ package exporter
 
 import (
 	"bufio"
+	"context"
 	"fmt"
-	_ "github.com/cheezypoofs/ring-exporter/ringapi"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
 	"golang.org/x/crypto/ssh/terminal"
 	"os"
 	"strings"
 	"syscall"
 )
 
+// ResendKeyword may be entered instead of a 2FA code to have it sent again.
+const ResendKeyword = "resend"
+
+// parseCode maps ResendKeyword to `ringapi.ErrResend2FACode`.
+func parseCode(code string) (string, error) {
+	if strings.EqualFold(code, ResendKeyword) {
+		return "", ringapi.ErrResend2FACode
+	}
+	return code, nil
+}
+
 type CliAuthenticator struct {
 }
 
@@ -29,10 +41,14 @@ func (*CliAuthenticator) PromptCredentials() (string, string, error) {
 }
 
 // Prompt2FACode implements `ringapi.Authenticator` interface
-func (*CliAuthenticator) Prompt2FACode() (string, error) {
+func (*CliAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
 	reader := bufio.NewReader(os.Stdin)
 
-	fmt.Print("Enter 2FA Code: ")
+	if challenge.Method == ringapi.SMSChallenge {
+		fmt.Printf("%s (or '%s' to send it again): ", challenge.Prompt(), ResendKeyword)
+	} else {
+		fmt.Printf("%s: ", challenge.Prompt())
+	}
 	code, _ := reader.ReadString('\n')
-	return strings.TrimSpace(code), nil
+	return parseCode(strings.TrimSpace(code))
 }
@@ -0,0 +1,274 @@
+package exporter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	CliAuthMethod   = "cli"
+	EnvAuthMethod   = "env"
+	FileAuthMethod  = "file"
+	StdinAuthMethod = "stdin"
+
+	// Environment variables read by EnvAuthenticator
+	UsernameEnv = OverrideEnvPrefix + "USERNAME"
+	PasswordEnv = OverrideEnvPrefix + "PASSWORD"
+	CodeEnv     = OverrideEnvPrefix + "2FA_CODE"
+)
+
+// AuthMethods lists the values accepted for `AuthConfig.Method`.
+var AuthMethods = []string{CliAuthMethod, EnvAuthMethod, FileAuthMethod, StdinAuthMethod}
+
+// NewAuthenticator creates the `ringapi.Authenticator` selected by `cfg`.
+// Relative paths are relative to the directory holding the config file.
+func NewAuthenticator(cfgFile string, cfg AuthConfig) (ringapi.Authenticator, error) {
+	resolve := func(path string) string {
+		return StatePath(cfgFile, StateConfig{Path: path})
+	}
+	codeWaiter := &codeWaiter{
+		filename: resolve(cfg.CodeFile),
+		timeout:  time.Duration(cfg.CodeTimeoutSeconds) * time.Second,
+	}
+
+	switch cfg.Method {
+	case CliAuthMethod:
+		return &CliAuthenticator{}, nil
+	case EnvAuthMethod:
+		return &EnvAuthenticator{
+			codeWaiter: codeWaiter,
+		}, nil
+	case FileAuthMethod:
+		if cfg.UsernameFile == "" || cfg.PasswordFile == "" {
+			return nil, fmt.Errorf("The file auth method requires auth_config.username_file and auth_config.password_file")
+		}
+		return &FileAuthenticator{
+			UsernameFile: resolve(cfg.UsernameFile),
+			PasswordFile: resolve(cfg.PasswordFile),
+			codeWaiter:   codeWaiter,
+		}, nil
+	case StdinAuthMethod:
+		return NewStdinAuthenticator(os.Stdin), nil
+	default:
+		return nil, fmt.Errorf("Unknown auth method '%s'", cfg.Method)
+	}
+}
+
+// newReauthenticator creates the authenticator the monitor authorizes a new
+// token with when the current one is rejected. It's nil unless `cfg` allows that.
+func newReauthenticator(cfgFile string, cfg AuthConfig) (ringapi.Authenticator, error) {
+	if !cfg.Reauthenticate {
+		return nil, nil
+	}
+	return NewAuthenticator(cfgFile, cfg)
+}
+
+// codeWaiter waits for a 2FA code to show up in a file or named pipe.
+type codeWaiter struct {
+	filename string
+	timeout  time.Duration
+}
+
+func (w *codeWaiter) waitForCode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	if challenge.Method == ringapi.SMSChallenge {
+		log.Printf("%s (write '%s' instead to have it sent again)", challenge.Prompt(), ResendKeyword)
+	} else {
+		log.Printf("%s", challenge.Prompt())
+	}
+	code, err := w.readCode(ctx)
+	if err != nil {
+		return "", err
+	}
+	return parseCode(code)
+}
+
+// readCode waits for the code until it's written, the timeout passes (except
+// for a named pipe, which is waited on for as long as it takes) or `ctx` is done.
+func (w *codeWaiter) readCode(ctx context.Context) (string, error) {
+	if w.filename == "" {
+		return "", fmt.Errorf("A 2FA code is required but no auth_config.code_file was configured")
+	}
+
+	info, err := os.Stat(w.filename)
+	if err == nil && info.Mode()&os.ModeNamedPipe != 0 {
+		log.Printf("Waiting for the 2FA code to be written to %s", w.filename)
+		return readPipe(ctx, w.filename)
+	}
+
+	// Otherwise poll for the file to be written. Anything written before we
+	// started waiting is a stale code from a previous attempt.
+	log.Printf("Waiting up to %s for the 2FA code to be written to %s", w.timeout, w.filename)
+	start := time.Now().Add(-time.Second)
+	deadline := time.Now().Add(w.timeout)
+
+	for time.Now().Before(deadline) {
+		info, err := os.Stat(w.filename)
+		if err == nil && info.ModTime().After(start) && info.Size() > 0 {
+			data, err := ioutil.ReadFile(w.filename)
+			if err != nil {
+				return "", err
+			}
+			// Best effort so the code can't be reused by accident
+			os.Remove(w.filename)
+			return string(bytes.TrimSpace(data)), nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+
+	return "", fmt.Errorf("Timed out waiting for the 2FA code in %s", w.filename)
+}
+
+// readPipe reads the first line written to the named pipe `filename`.
+// Opening a pipe normally blocks until somebody opens it to write, which
+// couldn't be interrupted. Opened non-blocking, reads come back empty until
+// then instead and those are retried until `ctx` is done.
+func readPipe(ctx context.Context, filename string) (string, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var data []byte
+	buf := make([]byte, 256)
+	for {
+		// Don't block for long on a writer that hasn't written anything yet
+		f.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := f.Read(buf)
+		data = append(data, buf[:n]...)
+
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return string(bytes.TrimSpace(data[:i])), nil
+		}
+		switch {
+		case err == io.EOF && len(data) > 0:
+			// The writer is done
+			return string(bytes.TrimSpace(data)), nil
+		case err == io.EOF:
+			// Nobody has opened it to write yet
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(time.Second):
+			}
+		case os.IsTimeout(err):
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+		case err != nil:
+			return "", err
+		}
+	}
+}
+
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// EnvAuthenticator reads the credentials from the environment. The 2FA code
+// is also taken from the environment if present, but since it usually isn't
+// known up front it's otherwise waited for in the configured code file.
+type EnvAuthenticator struct {
+	*codeWaiter
+	// The environment can't change, so it's only looked at for the first code
+	envCodeUsed bool
+}
+
+// PromptCredentials implements `ringapi.Authenticator` interface
+func (a *EnvAuthenticator) PromptCredentials() (string, string, error) {
+	username, password := os.Getenv(UsernameEnv), os.Getenv(PasswordEnv)
+	if username == "" || password == "" {
+		return "", "", fmt.Errorf("%s and %s must be set", UsernameEnv, PasswordEnv)
+	}
+	return username, password, nil
+}
+
+// Prompt2FACode implements `ringapi.Authenticator` interface
+func (a *EnvAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	if code := strings.TrimSpace(os.Getenv(CodeEnv)); code != "" && !a.envCodeUsed {
+		a.envCodeUsed = true
+		return parseCode(code)
+	}
+	return a.waitForCode(ctx, challenge)
+}
+
+// FileAuthenticator reads the credentials from files, such as Docker secrets,
+// and waits for the 2FA code in the configured code file.
+type FileAuthenticator struct {
+	UsernameFile string
+	PasswordFile string
+	*codeWaiter
+}
+
+// PromptCredentials implements `ringapi.Authenticator` interface
+func (a *FileAuthenticator) PromptCredentials() (string, string, error) {
+	username, err := ioutil.ReadFile(a.UsernameFile)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Failed to read username")
+	}
+	password, err := ioutil.ReadFile(a.PasswordFile)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Failed to read password")
+	}
+	return string(bytes.TrimSpace(username)), string(bytes.TrimSpace(password)), nil
+}
+
+// Prompt2FACode implements `ringapi.Authenticator` interface
+func (a *FileAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	return a.waitForCode(ctx, challenge)
+}
+
+// StdinAuthenticator reads the username, password and then the 2FA code as
+// lines from a pipe rather than a terminal.
+type StdinAuthenticator struct {
+	reader *bufio.Reader
+}
+
+// NewStdinAuthenticator creates a StdinAuthenticator reading from `r`.
+func NewStdinAuthenticator(r io.Reader) *StdinAuthenticator {
+	return &StdinAuthenticator{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// PromptCredentials implements `ringapi.Authenticator` interface
+func (a *StdinAuthenticator) PromptCredentials() (string, string, error) {
+	username, err := readLine(a.reader)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Failed to read username")
+	}
+	password, err := readLine(a.reader)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Failed to read password")
+	}
+	return username, password, nil
+}
+
+// Prompt2FACode implements `ringapi.Authenticator` interface
+func (a *StdinAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	log.Printf("%s on stdin", challenge.Prompt())
+	code, err := readLine(a.reader)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read 2FA code")
+	}
+	return parseCode(code)
+}
@@ -0,0 +1,317 @@
+package exporter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webAuthCredentials = "credentials"
+	webAuthWorking     = "working"
+	webAuthCode        = "code"
+	webAuthDone        = "done"
+	webAuthFailed      = "failed"
+
+	// how long a form submission waits for Ring to respond before just
+	// showing the current state
+	webAuthSubmitWait = time.Minute
+)
+
+var webAuthTemplate = template.Must(template.New("init").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Ring Exporter</title></head>
+<body>
+<h1>Ring Exporter</h1>
+{{if eq .State "credentials"}}
+<form method="POST" action="/credentials">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>Username <input type="text" name="username" autofocus></label></p>
+<p><label>Password <input type="password" name="password"></label></p>
+<p><input type="submit" value="Sign in"></p>
+</form>
+{{else if eq .State "code"}}
+<form method="POST" action="/code">
+<input type="hidden" name="token" value="{{.Token}}">
+<p><label>{{.Prompt}} <input type="text" name="code" autocomplete="one-time-code" autofocus></label></p>
+<p><input type="submit" value="Verify">{{if .Resendable}} <input type="submit" name="resend" value="Send it again">{{end}}</p>
+</form>
+{{else if eq .State "working"}}
+<p>Talking to Ring&hellip; <a href="/">Refresh</a></p>
+{{else if eq .State "done"}}
+<p>Success! The token has been stored. You may close this page.</p>
+{{else}}
+<p>Authorization failed: {{.Error}}</p>
+{{end}}
+</body>
+</html>
+`))
+
+// WebAuthenticator implements `ringapi.Authenticator` by serving a small
+// page with a credentials form and then a 2FA code form, and blocking until
+// they're submitted.
+type WebAuthenticator struct {
+	server      *http.Server
+	credentials chan [2]string
+	codes       chan string
+	// token is embedded in the forms so that other sites can't submit them
+	token string
+	// remote is set if the page may be reached by other hosts
+	remote bool
+
+	lock      sync.Mutex
+	state     string
+	err       error
+	challenge *ringapi.LoginChallenge
+	changed   chan struct{}
+}
+
+// NewWebAuthenticator starts serving the forms on `addr`. The credentials
+// are posted in plaintext, so unless `allowRemote`, `addr` must be a loopback
+// address. One without a host (such as `:8080`) listens on 127.0.0.1.
+func NewWebAuthenticator(addr string, allowRemote bool) (*WebAuthenticator, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" && !allowRemote {
+		host = "127.0.0.1"
+	}
+	if !allowRemote && !isLoopbackHost(host) {
+		return nil, fmt.Errorf("%s is not a loopback address. The credentials would be sent over plain HTTP, so allow that explicitly to use it", addr)
+	}
+
+	token := make([]byte, 16)
+	if _, err = rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &WebAuthenticator{
+		credentials: make(chan [2]string),
+		codes:       make(chan string),
+		token:       hex.EncodeToString(token),
+		remote:      allowRemote,
+		state:       webAuthWorking,
+		changed:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.handleIndex)
+	mux.HandleFunc("/credentials", a.handleCredentials)
+	mux.HandleFunc("/code", a.handleCode)
+	a.server = &http.Server{Handler: a.checkHost(mux)}
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("Failed to serve the init page: %v", err)
+		}
+	}()
+
+	log.Printf("Visit http://%s/ to sign in", listener.Addr())
+	return a, nil
+}
+
+// isLoopbackHost returns true if `host` is localhost or a loopback IP.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkHost refuses requests for other host names when listening on a
+// loopback address, which keeps DNS rebinding from reaching the page.
+func (a *WebAuthenticator) checkHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !a.remote && !isLoopbackHost(host) {
+			http.Error(w, "Unexpected host", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkOrigin makes sure a form submission came from our own page.
+func (a *WebAuthenticator) checkOrigin(r *http.Request) error {
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(a.token)) != 1 {
+		return fmt.Errorf("The form is missing the session token")
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		// Not sent by every client. The token is still checked.
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != r.Host {
+		return fmt.Errorf("Cross-origin submission from '%s'", origin)
+	}
+	return nil
+}
+
+// setState transitions and wakes anybody waiting on a transition.
+func (a *WebAuthenticator) setState(state string, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.state = state
+	a.err = err
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+func (a *WebAuthenticator) current() (string, *ringapi.LoginChallenge, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.state, a.challenge, a.err
+}
+
+// claim atomically moves from `expected` to working so that only one
+// submission is accepted. It returns a channel closed on the next transition.
+func (a *WebAuthenticator) claim(expected string) (<-chan struct{}, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.state != expected {
+		return nil, false
+	}
+	a.state = webAuthWorking
+	close(a.changed)
+	a.changed = make(chan struct{})
+	return a.changed, true
+}
+
+// PromptCredentials implements `ringapi.Authenticator` interface
+func (a *WebAuthenticator) PromptCredentials() (string, string, error) {
+	a.setState(webAuthCredentials, nil)
+	credentials := <-a.credentials
+	return credentials[0], credentials[1], nil
+}
+
+// Prompt2FACode implements `ringapi.Authenticator` interface
+func (a *WebAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	a.lock.Lock()
+	a.challenge = challenge
+	a.lock.Unlock()
+
+	a.setState(webAuthCode, nil)
+	select {
+	case code := <-a.codes:
+		return parseCode(code)
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Finish reports the outcome of authorizing to the page and then shuts the
+// server down once the page has been shown.
+func (a *WebAuthenticator) Finish(err error) {
+	if err != nil {
+		a.setState(webAuthFailed, err)
+	} else {
+		a.setState(webAuthDone, nil)
+	}
+
+	// Shutdown waits for the pending submission to render the outcome
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.server.Shutdown(ctx)
+}
+
+func (a *WebAuthenticator) render(w http.ResponseWriter) {
+	state, challenge, err := a.current()
+	data := struct {
+		State      string
+		Error      error
+		Prompt     string
+		Resendable bool
+		Token      string
+	}{State: state, Error: err, Token: a.token}
+	if challenge != nil {
+		data.Prompt = challenge.Prompt()
+		data.Resendable = challenge.Method == ringapi.SMSChallenge
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := webAuthTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render the init page: %v", err)
+	}
+}
+
+func (a *WebAuthenticator) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	a.render(w)
+}
+
+// submit hands a form value to whoever is prompting for it and then waits
+// for the outcome so that it can be rendered.
+func (a *WebAuthenticator) submit(w http.ResponseWriter, r *http.Request, expected string, deliver func()) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err := a.checkOrigin(r); err != nil {
+		log.Printf("Rejected a submission to the init page: %v", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	changed, ok := a.claim(expected)
+	if !ok {
+		// Stale or duplicate submission. Just show where we are.
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	deliver()
+
+	select {
+	case <-changed:
+	case <-time.After(webAuthSubmitWait):
+	case <-r.Context().Done():
+		return
+	}
+	a.render(w)
+}
+
+func (a *WebAuthenticator) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	a.submit(w, r, webAuthCredentials, func() {
+		a.credentials <- [2]string{strings.TrimSpace(r.FormValue("username")), r.FormValue("password")}
+	})
+}
+
+func (a *WebAuthenticator) handleCode(w http.ResponseWriter, r *http.Request) {
+	a.submit(w, r, webAuthCode, func() {
+		if r.FormValue("resend") != "" {
+			a.codes <- ResendKeyword
+			return
+		}
+		a.codes <- strings.TrimSpace(r.FormValue("code"))
+	})
+}
@@ -1,16 +1,24 @@
 package exporter
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/cheezypoofs/ring-exporter/ringapi"
 	"github.com/pkg/errors"
 	"io/ioutil"
+	"log"
+	"strings"
 )
 
 // WebConfig contains the serializable config items for the web service.
 type WebConfig struct {
-	Port         uint32 `json:"port"`
-	MetricsRoute string `json:"metrics_route"`
+	// ListenAddress is `host:port` or `unix:/path/to/socket`. If empty, all
+	// interfaces are bound on Port.
+	ListenAddress string `json:"listen_address" yaml:"listen_address" toml:"listen_address"`
+	Port          uint32 `json:"port" yaml:"port" toml:"port"`
+	MetricsRoute  string `json:"metrics_route" yaml:"metrics_route" toml:"metrics_route"`
+	// ConfigFile enables TLS and basic auth. It is in the format of the
+	// Prometheus exporter-toolkit web config file.
+	ConfigFile string `json:"config_file" yaml:"config_file" toml:"config_file"`
 }
 
 // EnsureWebConfigDefaults handles setting sane defaults
@@ -29,12 +37,86 @@ func EnsureWebConfigDefaults(config *WebConfig) bool {
 	return dirty
 }
 
+// StateConfig selects where the state (token, counters, etc) is kept.
+type StateConfig struct {
+	// Backend is one of `file`, `bolt` or `memory`.
+	Backend string `json:"backend" yaml:"backend" toml:"backend"`
+	// Path is the state file (or database). Relative paths are relative to
+	// the directory holding the config file.
+	Path string `json:"path" yaml:"path" toml:"path"`
+	// KeyFile holds the passphrase to encrypt the token with. The token is
+	// only encrypted if a key is provided here or by the environment.
+	KeyFile string `json:"key_file" yaml:"key_file" toml:"key_file"`
+}
+
+// EnsureStateConfigDefaults handles setting sane defaults
+// and migrating the config forward. It returns `true` if
+// any changes were made.
+func EnsureStateConfigDefaults(config *StateConfig) bool {
+	dirty := false
+	if config.Backend == "" {
+		dirty = true
+		config.Backend = FileStateBackend
+	}
+	if config.Path == "" {
+		switch config.Backend {
+		case FileStateBackend:
+			dirty = true
+			config.Path = "ring-state.json"
+		case BoltStateBackend:
+			dirty = true
+			config.Path = "ring-state.db"
+		}
+	}
+	return dirty
+}
+
+// AuthConfig selects how credentials and 2FA codes are obtained when a
+// token needs to be authorized.
+type AuthConfig struct {
+	// Method is one of `cli`, `env`, `file` or `stdin`.
+	Method       string `json:"method" yaml:"method" toml:"method"`
+	UsernameFile string `json:"username_file" yaml:"username_file" toml:"username_file"`
+	PasswordFile string `json:"password_file" yaml:"password_file" toml:"password_file"`
+	// CodeFile is a file or named pipe to wait on for the 2FA code.
+	CodeFile           string `json:"code_file" yaml:"code_file" toml:"code_file"`
+	CodeTimeoutSeconds uint32 `json:"code_timeout_seconds" yaml:"code_timeout_seconds" toml:"code_timeout_seconds"`
+	// Reauthenticate lets the monitor authorize a new token with the `env`
+	// or `file` method when the current one is rejected.
+	Reauthenticate bool `json:"reauthenticate" yaml:"reauthenticate" toml:"reauthenticate"`
+}
+
+// EnsureAuthConfigDefaults handles setting sane defaults
+// and migrating the config forward. It returns `true` if
+// any changes were made.
+func EnsureAuthConfigDefaults(config *AuthConfig) bool {
+	dirty := false
+	if config.Method == "" {
+		dirty = true
+		config.Method = CliAuthMethod
+	}
+	if config.CodeTimeoutSeconds == 0 {
+		dirty = true
+		config.CodeTimeoutSeconds = 5 * 60
+	}
+	return dirty
+}
+
 type Config struct {
-	ApiConfig ringapi.ApiConfig `json:"api_config"`
-	WebConfig WebConfig         `json:"web_config"`
+	ApiConfig   ringapi.ApiConfig `json:"api_config" yaml:"api_config" toml:"api_config"`
+	WebConfig   WebConfig         `json:"web_config" yaml:"web_config" toml:"web_config"`
+	StateConfig StateConfig       `json:"state_config" yaml:"state_config" toml:"state_config"`
+	AuthConfig  AuthConfig        `json:"auth_config" yaml:"auth_config" toml:"auth_config"`
 
-	PollIntervalSeconds uint32 `json:"poll_interval_seconds"`
-	SaveIntervalSeconds uint32 `json:"save_interval_seconds"`
+	PollIntervalSeconds uint32 `json:"poll_interval_seconds" yaml:"poll_interval_seconds" toml:"poll_interval_seconds"`
+	SaveIntervalSeconds uint32 `json:"save_interval_seconds" yaml:"save_interval_seconds" toml:"save_interval_seconds"`
+	// BatteryLowPercent is the battery level below which the event stream
+	// reports a low battery. Zero turns that off, so unset is nil.
+	BatteryLowPercent *uint32 `json:"battery_low_percent,omitempty" yaml:"battery_low_percent,omitempty" toml:"battery_low_percent,omitempty"`
+
+	// Accounts are monitored in addition to the default account configured
+	// above. The web, poll and save settings are shared by all of them.
+	Accounts []AccountConfig `json:"accounts,omitempty" yaml:"accounts,omitempty" toml:"accounts,omitempty"`
 }
 
 func EnsureConfigDefaults(cfg *Config) bool {
@@ -47,41 +129,202 @@ func EnsureConfigDefaults(cfg *Config) bool {
 		dirty = true
 		cfg.SaveIntervalSeconds = 5 * 60
 	}
+	if cfg.BatteryLowPercent == nil {
+		dirty = true
+		batteryLowPercent := uint32(20)
+		cfg.BatteryLowPercent = &batteryLowPercent
+	}
 	if ringapi.EnsureApiConfigDefaults(&cfg.ApiConfig) {
 		dirty = true
 	}
 	if EnsureWebConfigDefaults(&cfg.WebConfig) {
 		dirty = true
 	}
+	if EnsureStateConfigDefaults(&cfg.StateConfig) {
+		dirty = true
+	}
+	if EnsureAuthConfigDefaults(&cfg.AuthConfig) {
+		dirty = true
+	}
+	for i := range cfg.Accounts {
+		if EnsureAccountConfigDefaults(&cfg.Accounts[i]) {
+			dirty = true
+		}
+	}
+	return dirty
+}
+
+// EnsureReadOnlyConfigDefaults is `EnsureConfigDefaults` for a config that
+// won't be written back. A missing hardware id is left empty since a random
+// one would change every time.
+func EnsureReadOnlyConfigDefaults(cfg *Config) bool {
+	hardwareIds := []string{cfg.ApiConfig.HardwareId}
+	for _, account := range cfg.Accounts {
+		hardwareIds = append(hardwareIds, account.ApiConfig.HardwareId)
+	}
+	dirty := EnsureConfigDefaults(cfg)
+	cfg.ApiConfig.HardwareId = hardwareIds[0]
+	for i := range cfg.Accounts {
+		cfg.Accounts[i].ApiConfig.HardwareId = hardwareIds[i+1]
+	}
 	return dirty
 }
 
+// LoadOptions alters how LoadConfigWithOptions treats the config file.
+type LoadOptions struct {
+	// AllowUnknownFields tolerates keys in the file that don't map to the
+	// config. By default they are an error since they are usually typos.
+	AllowUnknownFields bool
+	// ReadOnly applies defaults in memory only and never writes to the file.
+	// A missing hardware id is left empty so that it can be kept in the state
+	// instead (see `RingStateHandler.EnsureHardwareId`).
+	ReadOnly bool
+	// Overrides take precedence over both the file and the defaults. They
+	// are never written to the file.
+	Overrides ConfigOverrides
+}
+
+// LoadConfig loads the config with the default LoadOptions.
 func LoadConfig(filename string) (*Config, error) {
+	return LoadConfigWithOptions(filename, LoadOptions{})
+}
+
+// ReadConfig loads and parses the config file without applying defaults
+// or modifying the file.
+func ReadConfig(filename string, opts LoadOptions) (*Config, error) {
 	cfg := &Config{}
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to read config")
 	}
 
-	if json.Unmarshal(data, cfg); err != nil {
+	format := configFormatFor(filename)
+	if err = format.decode(filename, data, cfg, opts); err != nil {
 		return nil, errors.Wrapf(err, "Failed to deserialize config")
 	}
 
-	if EnsureConfigDefaults(cfg) {
-		SaveConfig(filename, cfg)
+	return cfg, nil
+}
+
+// LoadConfigWithOptions loads and parses the config file, applying defaults.
+// If defaults had to be applied, the file is migrated forward unless the
+// options are read-only. A file which fails to parse is never rewritten.
+func LoadConfigWithOptions(filename string, opts LoadOptions) (*Config, error) {
+	cfg, err := ReadConfig(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		EnsureReadOnlyConfigDefaults(cfg)
+	} else if EnsureConfigDefaults(cfg) {
+		if err = SaveConfig(filename, cfg); err != nil {
+			log.Printf("Unable to migrate config forward: %v", err)
+		}
+	}
+
+	if err = opts.Overrides.Apply(cfg); err != nil {
+		return nil, err
 	}
 
 	return cfg, nil
 }
 
+// ValidateConfig checks a config (with defaults applied) for values that
+// can't possibly work.
+func ValidateConfig(cfg *Config) error {
+	var problems []string
+
+	if cfg.WebConfig.Port == 0 || cfg.WebConfig.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("web_config.port %d is not a valid port", cfg.WebConfig.Port))
+	}
+	if err := validateListenAddress(cfg.WebConfig.ListenAddress); err != nil {
+		problems = append(problems, fmt.Sprintf("web_config.listen_address %v", err))
+	}
+	if !strings.HasPrefix(cfg.WebConfig.MetricsRoute, "/") {
+		problems = append(problems, fmt.Sprintf("web_config.metrics_route '%s' must begin with '/'", cfg.WebConfig.MetricsRoute))
+	}
+	if err := validateMetricsRoute(cfg.WebConfig.MetricsRoute); err != nil {
+		problems = append(problems, fmt.Sprintf("web_config.metrics_route %v", err))
+	}
+	if cfg.PollIntervalSeconds == 0 {
+		problems = append(problems, "poll_interval_seconds must be positive")
+	}
+	if cfg.SaveIntervalSeconds == 0 {
+		problems = append(problems, "save_interval_seconds must be positive")
+	}
+	if cfg.BatteryLowPercent != nil && *cfg.BatteryLowPercent > 100 {
+		problems = append(problems, fmt.Sprintf("battery_low_percent %d must be at most 100", *cfg.BatteryLowPercent))
+	}
+
+	problems = validateStateConfig("state_config", cfg.StateConfig, problems)
+	problems = validateAuthConfig("auth_config", cfg.AuthConfig, problems)
+
+	for i, account := range cfg.Accounts {
+		problems = validateStateConfig(fmt.Sprintf("accounts[%d].state_config", i), account.StateConfig, problems)
+		problems = validateAuthConfig(fmt.Sprintf("accounts[%d].auth_config", i), account.AuthConfig, problems)
+	}
+	problems = validateAccounts(cfg, problems)
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateStateConfig(prefix string, cfg StateConfig, problems []string) []string {
+	switch cfg.Backend {
+	case FileStateBackend, BoltStateBackend:
+		if cfg.Path == "" {
+			problems = append(problems, fmt.Sprintf("%s.path must not be empty", prefix))
+		}
+	case MemoryStateBackend:
+	default:
+		problems = append(problems, fmt.Sprintf("%s.backend '%s' must be one of file, bolt or memory", prefix, cfg.Backend))
+	}
+	return problems
+}
+
+func validateAuthConfig(prefix string, cfg AuthConfig, problems []string) []string {
+	validMethod := false
+	for _, method := range AuthMethods {
+		validMethod = validMethod || cfg.Method == method
+	}
+	if !validMethod {
+		problems = append(problems, fmt.Sprintf("%s.method '%s' must be one of %s", prefix, cfg.Method, strings.Join(AuthMethods, ", ")))
+	}
+
+	if cfg.Reauthenticate && cfg.Method != EnvAuthMethod && cfg.Method != FileAuthMethod {
+		problems = append(problems, fmt.Sprintf("%s.reauthenticate requires %s.method to be env or file", prefix, prefix))
+	}
+	return problems
+}
+
+// RedactConfig returns a copy of the config that is safe to display.
+func RedactConfig(cfg *Config) *Config {
+	redacted := *cfg
+	if redacted.ApiConfig.HardwareId != "" {
+		redacted.ApiConfig.HardwareId = "<redacted>"
+	}
+	redacted.Accounts = make([]AccountConfig, len(cfg.Accounts))
+	for i, account := range cfg.Accounts {
+		if account.ApiConfig.HardwareId != "" {
+			account.ApiConfig.HardwareId = "<redacted>"
+		}
+		redacted.Accounts[i] = account
+	}
+	return &redacted
+}
+
+// SaveConfig persists the config in the format implied by the file extension.
 func SaveConfig(filename string, cfg *Config) error {
-	data, err := json.MarshalIndent(cfg, "", " ")
+	data, err := configFormatFor(filename).encode(cfg)
 	if err != nil {
 		// unexpected
 		panic(err)
 	}
 
-	if err = ioutil.WriteFile(filename, data, 0600); err != nil {
+	if err = writeFileAtomic(filename, data, 0600); err != nil {
 		return errors.Wrapf(err, "Failed to persist config")
 	}
 	return nil
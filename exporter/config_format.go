@@ -0,0 +1,194 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// configFormat knows how to (de)serialize a Config in a particular file format.
+type configFormat struct {
+	decode func(filename string, data []byte, cfg *Config, opts LoadOptions) error
+	encode func(cfg *Config) ([]byte, error)
+}
+
+var (
+	jsonFormat = &configFormat{decode: decodeJsonConfig, encode: encodeJsonConfig}
+	yamlFormat = &configFormat{decode: decodeYamlConfig, encode: encodeYamlConfig}
+	tomlFormat = &configFormat{decode: decodeTomlConfig, encode: encodeTomlConfig}
+)
+
+// configFormatFor picks the format from the file extension. Anything
+// unrecognized is treated as JSON, which is what we've always used.
+func configFormatFor(filename string) *configFormat {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return yamlFormat
+	case ".toml":
+		return tomlFormat
+	default:
+		return jsonFormat
+	}
+}
+
+// ConfigError describes where in a config file parsing failed. Line and
+// Column are zero if the parser didn't say.
+type ConfigError struct {
+	Filename string
+	Line     int
+	Column   int
+	Err      error
+}
+
+func (e *ConfigError) Error() string {
+	switch {
+	case e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d: %v", e.Filename, e.Line, e.Column, e.Err)
+	case e.Line > 0:
+		return fmt.Sprintf("%s:%d: %v", e.Filename, e.Line, e.Err)
+	default:
+		return fmt.Sprintf("%s: %v", e.Filename, e.Err)
+	}
+}
+
+// Cause allows `errors.Cause` to find the underlying error
+func (e *ConfigError) Cause() error {
+	return e.Err
+}
+
+// newConfigError converts a byte offset into `data` to a line and column.
+func newConfigError(filename string, data []byte, offset int64, err error) *ConfigError {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - bytes.LastIndexByte(before, '\n')
+	return &ConfigError{
+		Filename: filename,
+		Line:     line,
+		Column:   column,
+		Err:      err,
+	}
+}
+
+var lineRegexp = regexp.MustCompile(`[Ll]ine (\d+)`)
+
+// newConfigErrorFromText scrapes the line number out of parsers which
+// only report it in the error text.
+func newConfigErrorFromText(filename string, err error) *ConfigError {
+	line := 0
+	if m := lineRegexp.FindStringSubmatch(err.Error()); m != nil {
+		line, _ = strconv.Atoi(m[1])
+	}
+	return &ConfigError{
+		Filename: filename,
+		Line:     line,
+		Err:      err,
+	}
+}
+
+// findKey returns the offset of the first submatch of `pattern` in `data`.
+// Since the parsers don't say where an unknown key is, it's -1 unless the
+// key is found exactly once. A wrong position is worse than none.
+func findKey(data []byte, pattern string) int64 {
+	matches := regexp.MustCompile(pattern).FindAllSubmatchIndex(data, 2)
+	if len(matches) != 1 {
+		return -1
+	}
+	return int64(matches[0][2])
+}
+
+// decodeJsonConfig strictly deserializes `data` into `cfg`.
+func decodeJsonConfig(filename string, data []byte, cfg *Config, opts LoadOptions) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if !opts.AllowUnknownFields {
+		decoder.DisallowUnknownFields()
+	}
+
+	if err := decoder.Decode(cfg); err != nil {
+		offset := decoder.InputOffset()
+		switch e := err.(type) {
+		case *json.SyntaxError:
+			offset = e.Offset
+		case *json.UnmarshalTypeError:
+			offset = e.Offset
+		default:
+			// The decoder doesn't report where an unknown field is, so go find it.
+			if name := strings.TrimPrefix(err.Error(), "json: unknown field "); name != err.Error() {
+				// `name` is already quoted
+				i := findKey(data, `(`+regexp.QuoteMeta(name)+`)\s*:`)
+				if i < 0 {
+					return &ConfigError{Filename: filename, Err: err}
+				}
+				offset = i
+			}
+		}
+		return newConfigError(filename, data, offset, err)
+	}
+
+	// Make sure there's nothing trailing the config object
+	if _, err := decoder.Token(); err != io.EOF {
+		return newConfigError(filename, data, decoder.InputOffset(), fmt.Errorf("unexpected data after config"))
+	}
+
+	return nil
+}
+
+func encodeJsonConfig(cfg *Config) ([]byte, error) {
+	return json.MarshalIndent(cfg, "", " ")
+}
+
+// decodeYamlConfig strictly deserializes `data` into `cfg`.
+func decodeYamlConfig(filename string, data []byte, cfg *Config, opts LoadOptions) error {
+	unmarshal := yaml.UnmarshalStrict
+	if opts.AllowUnknownFields {
+		unmarshal = yaml.Unmarshal
+	}
+
+	if err := unmarshal(data, cfg); err != nil {
+		return newConfigErrorFromText(filename, err)
+	}
+	return nil
+}
+
+func encodeYamlConfig(cfg *Config) ([]byte, error) {
+	return yaml.Marshal(cfg)
+}
+
+// decodeTomlConfig strictly deserializes `data` into `cfg`.
+func decodeTomlConfig(filename string, data []byte, cfg *Config, opts LoadOptions) error {
+	md, err := toml.Decode(string(data), cfg)
+	if err != nil {
+		return newConfigErrorFromText(filename, err)
+	}
+
+	if undecoded := md.Undecoded(); len(undecoded) > 0 && !opts.AllowUnknownFields {
+		key := undecoded[0]
+		err = fmt.Errorf("unknown field \"%s\"", key.String())
+
+		// The decoder doesn't report where an unknown key is, so go find it
+		// as a key (or table) being defined at the start of a line.
+		name := regexp.QuoteMeta(key[len(key)-1])
+		if i := findKey(data, `(?m)^[ \t]*(?:\[+[ \t]*)?("`+name+`"|`+name+`)[ \t]*[=\]]`); i >= 0 {
+			return newConfigError(filename, data, i, err)
+		}
+		return &ConfigError{Filename: filename, Err: err}
+	}
+	return nil
+}
+
+func encodeTomlConfig(cfg *Config) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := toml.NewEncoder(buf).Encode(cfg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,104 @@
+package exporter
+
+import "testing"
+
+func TestDecodeConfigErrorPosition(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		line     int
+		column   int
+	}{
+		{
+			name:     "json unknown key",
+			filename: "ring-config.json",
+			data:     "{\n \"web_config\": {\n  \"prot\": 9100\n }\n}\n",
+			line:     3,
+			column:   3,
+		},
+		{
+			name:     "json unknown key also used as a value",
+			filename: "ring-config.json",
+			data:     "{\n \"state_config\": {\"path\": \"prot\"},\n \"web_config\": {\"prot\": 9100}\n}\n",
+			line:     3,
+			column:   17,
+		},
+		{
+			name:     "json unknown key found twice",
+			filename: "ring-config.json",
+			data:     "{\n \"accounts\": [\n  {\"name\": \"a\", \"prot\": 1},\n  {\"name\": \"b\", \"prot\": 2}\n ]\n}\n",
+		},
+		{
+			name:     "json syntax error",
+			filename: "ring-config.json",
+			data:     "{\n \"poll_interval_seconds\": 60,\n}\n",
+			line:     3,
+			column:   2,
+		},
+		{
+			name:     "toml unknown key",
+			filename: "ring-config.toml",
+			data:     "poll_interval_seconds = 60\n\n[web_config]\n  prot = 9100\n",
+			line:     4,
+			column:   3,
+		},
+		{
+			name:     "toml unknown table",
+			filename: "ring-config.toml",
+			data:     "# [wbe_config] is a typo\n[wbe_config]\nport = 9100\n",
+			line:     2,
+			column:   2,
+		},
+		{
+			name:     "toml unknown key also used as a value",
+			filename: "ring-config.toml",
+			data:     "[state_config]\npath = \"prot\"\n\n[web_config]\nprot = 9100\n",
+			line:     5,
+			column:   1,
+		},
+		{
+			name:     "yaml unknown key",
+			filename: "ring-config.yaml",
+			data:     "poll_interval_seconds: 60\nweb_config:\n  prot: 9100\n",
+			line:     3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{}
+			err := configFormatFor(test.filename).decode(test.filename, []byte(test.data), cfg, LoadOptions{})
+			if err == nil {
+				t.Fatalf("Expected an error")
+			}
+
+			cfgErr, ok := err.(*ConfigError)
+			if !ok {
+				t.Fatalf("Expected a ConfigError, got %T: %v", err, err)
+			}
+			if cfgErr.Line != test.line || cfgErr.Column != test.column {
+				t.Errorf("Expected %d:%d, got %d:%d (%v)", test.line, test.column, cfgErr.Line, cfgErr.Column, err)
+			}
+		})
+	}
+}
+
+func TestDecodeConfigAllowUnknownFields(t *testing.T) {
+	tests := map[string]string{
+		"ring-config.json": `{"web_config": {"port": 9101, "prot": 9100}}`,
+		"ring-config.toml": "[web_config]\nport = 9101\nprot = 9100\n",
+		"ring-config.yaml": "web_config:\n  port: 9101\n  prot: 9100\n",
+	}
+
+	for filename, data := range tests {
+		cfg := &Config{}
+		if err := configFormatFor(filename).decode(filename, []byte(data), cfg, LoadOptions{AllowUnknownFields: true}); err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		if cfg.WebConfig.Port != 9101 {
+			t.Errorf("%s: expected port 9101, got %d", filename, cfg.WebConfig.Port)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/oauth2"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// StateKeyEnv names the environment variable that may hold the passphrase
+	// used to encrypt the token in the state.
+	StateKeyEnv = OverrideEnvPrefix + "STATE_KEY"
+
+	tokenCipherVersion = "v1:"
+	saltSize           = 16
+	nonceSize          = 24
+	keySize            = 32
+)
+
+// TokenCipher encrypts the OAUTH2 token at rest with a NaCl secretbox. The
+// key is derived from a passphrase with scrypt.
+type TokenCipher struct {
+	passphrase []byte
+
+	// the key for our own salt, derived once
+	salt []byte
+	key  *[keySize]byte
+}
+
+// NewTokenCipher creates a TokenCipher for `passphrase`.
+func NewTokenCipher(passphrase []byte) (*TokenCipher, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("The state key must not be empty")
+	}
+
+	c := &TokenCipher{
+		passphrase: passphrase,
+		salt:       make([]byte, saltSize),
+	}
+	if _, err := rand.Read(c.salt); err != nil {
+		return nil, err
+	}
+
+	key, err := c.deriveKey(c.salt)
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	return c, nil
+}
+
+func (c *TokenCipher) deriveKey(salt []byte) (*[keySize]byte, error) {
+	if c.key != nil && bytes.Equal(salt, c.salt) {
+		return c.key, nil
+	}
+
+	derived, err := scrypt.Key(c.passphrase, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	key := &[keySize]byte{}
+	copy(key[:], derived)
+	return key, nil
+}
+
+// Seal encrypts the token into a printable string.
+func (c *TokenCipher) Seal(token *oauth2.Token) (string, error) {
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := [nonceSize]byte{}
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+
+	out := append([]byte{}, c.salt...)
+	out = append(out, nonce[:]...)
+	out = secretbox.Seal(out, plaintext, &nonce, c.key)
+
+	return tokenCipherVersion + base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Open decrypts a token sealed by `Seal`.
+func (c *TokenCipher) Open(sealed string) (*oauth2.Token, error) {
+	if !strings.HasPrefix(sealed, tokenCipherVersion) {
+		return nil, fmt.Errorf("Unsupported encrypted token format")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, tokenCipherVersion))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Encrypted token is corrupt")
+	}
+	if len(data) < saltSize+nonceSize+secretbox.Overhead {
+		return nil, fmt.Errorf("Encrypted token is corrupt")
+	}
+
+	salt := data[:saltSize]
+	nonce := [nonceSize]byte{}
+	copy(nonce[:], data[saltSize:saltSize+nonceSize])
+
+	key, err := c.deriveKey(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, ok := secretbox.Open(nil, data[saltSize+nonceSize:], &nonce, key)
+	if !ok {
+		return nil, fmt.Errorf("Unable to decrypt the token. Is the state key correct?")
+	}
+
+	token := &oauth2.Token{}
+	if err = json.Unmarshal(plaintext, token); err != nil {
+		return nil, errors.Wrapf(err, "Decrypted token is corrupt")
+	}
+	return token, nil
+}
+
+// ReadStateKey finds the passphrase for encrypting the token, first from the
+// environment and then from the configured key file. It returns nil if neither
+// is set, meaning the token is not encrypted.
+func ReadStateKey(cfgFile string, cfg StateConfig) ([]byte, error) {
+	if key := os.Getenv(StateKeyEnv); key != "" {
+		return []byte(key), nil
+	}
+
+	if cfg.KeyFile == "" {
+		return nil, nil
+	}
+
+	keyFile := StatePath(cfgFile, StateConfig{Path: cfg.KeyFile})
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read state key")
+	}
+	return bytes.TrimSpace(data), nil
+}
@@ -0,0 +1,85 @@
+package exporter
+
+import (
+	"golang.org/x/oauth2"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testToken() *oauth2.Token {
+	return &oauth2.Token{
+		AccessToken:  "access",
+		TokenType:    "Bearer",
+		RefreshToken: "refresh",
+		Expiry:       time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestTokenCipherRoundTrip(t *testing.T) {
+	c, err := NewTokenCipher([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := testToken()
+	sealed, err := c.Seal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, token.AccessToken) || strings.Contains(sealed, token.RefreshToken) {
+		t.Errorf("Sealed token contains the plaintext: %s", sealed)
+	}
+
+	// A new cipher with the same passphrase has its own salt, as after a restart
+	other, err := NewTokenCipher([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cipher := range []*TokenCipher{c, other} {
+		opened, err := cipher.Open(sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opened.AccessToken != token.AccessToken || opened.RefreshToken != token.RefreshToken || !opened.Expiry.Equal(token.Expiry) {
+			t.Errorf("Expected %+v, got %+v", token, opened)
+		}
+	}
+}
+
+func TestTokenCipherOpenFailures(t *testing.T) {
+	c, err := NewTokenCipher([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := c.Seal(testToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrong, err := NewTokenCipher([]byte("battery staple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = wrong.Open(sealed); err == nil {
+		t.Errorf("Expected the wrong passphrase to fail")
+	}
+
+	tests := map[string]string{
+		"unversioned": strings.TrimPrefix(sealed, tokenCipherVersion),
+		"not base64":  tokenCipherVersion + "!!!",
+		"too short":   tokenCipherVersion + "AAAA",
+		"tampered":    sealed[:len(sealed)-4] + "AAAA",
+	}
+	for name, bad := range tests {
+		if _, err = c.Open(bad); err == nil {
+			t.Errorf("%s: expected a failure", name)
+		}
+	}
+}
+
+func TestNewTokenCipherRejectsEmptyPassphrase(t *testing.T) {
+	if _, err := NewTokenCipher(nil); err == nil {
+		t.Errorf("Expected an empty passphrase to be rejected")
+	}
+}
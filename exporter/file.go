@@ -0,0 +1,95 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// backupFilename names the previous generation of `filename`.
+func backupFilename(filename string) string {
+	return filename + ".bak"
+}
+
+// writeFileAtomic replaces `filename` with `data` such that a crash (or a full
+// disk) leaves either the previous or the new content in place, never a
+// truncated file. The previous generation is kept as a `.bak` file.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	// Clean up after ourselves on any failure. Once renamed, this is a no-op.
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	// Keep the previous generation around. A hard link keeps the primary in
+	// place the whole time. Fall back to a copy where links aren't supported.
+	if previous, err := ioutil.ReadFile(filename); err == nil {
+		backup := backupFilename(filename)
+		os.Remove(backup)
+		if err = os.Link(filename, backup); err != nil {
+			if err = ioutil.WriteFile(backup, previous, perm); err != nil {
+				log.Printf("Unable to keep a backup of %s: %v", filename, err)
+			}
+		}
+	}
+
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+
+	// Make sure the rename itself is durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// readFileWithBackup reads `filename` and hands it to `parse`. If the file
+// exists but can't be read or parsed, the backup written by writeFileAtomic
+// is tried instead. The error from the primary is returned if both fail. A
+// missing file is returned as is; it may have been deleted on purpose.
+func readFileWithBackup(filename string, parse func(data []byte) error) error {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err = parse(data); err == nil {
+			return nil
+		}
+	}
+
+	backup := backupFilename(filename)
+	data, bErr := ioutil.ReadFile(backup)
+	if bErr != nil {
+		return err
+	}
+	if bErr = parse(data); bErr != nil {
+		return err
+	}
+
+	log.Printf("Recovered %s from %s after: %v", filename, backup, err)
+	return nil
+}
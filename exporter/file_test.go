@@ -0,0 +1,105 @@
+package exporter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readWithBackup(filename string) (string, error) {
+	var content string
+	err := readFileWithBackup(filename, func(data []byte) error {
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			return os.ErrInvalid
+		}
+		content = string(data)
+		return nil
+	})
+	return content, err
+}
+
+func TestWriteFileAtomicKeepsBackup(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ring-state.json")
+
+	if err := writeFileAtomic(filename, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupFilename(filename)); !os.IsNotExist(err) {
+		t.Errorf("Expected no backup of a new file, got %v", err)
+	}
+
+	if err := writeFileAtomic(filename, []byte("second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filename); string(data) != "second\n" {
+		t.Errorf("Expected the new content, got %q", data)
+	}
+	if data, _ := ioutil.ReadFile(backupFilename(filename)); string(data) != "first\n" {
+		t.Errorf("Expected the previous content in the backup, got %q", data)
+	}
+
+	// Nothing else is left behind
+	entries, err := ioutil.ReadDir(filepath.Dir(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected only the file and its backup, got %d files", len(entries))
+	}
+}
+
+func TestReadFileWithBackup(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary *string
+		backup  *string
+		content string
+		missing bool
+		fails   bool
+	}{
+		{name: "primary", primary: strPtr("second\n"), backup: strPtr("first\n"), content: "second\n"},
+		{name: "truncated primary", primary: strPtr("sec"), backup: strPtr("first\n"), content: "first\n"},
+		{name: "empty primary", primary: strPtr(""), backup: strPtr("first\n"), content: "first\n"},
+		{name: "damaged primary and backup", primary: strPtr("sec"), backup: strPtr("fir"), fails: true},
+		{name: "damaged primary and no backup", primary: strPtr("sec"), fails: true},
+		{name: "missing primary", backup: strPtr("first\n"), missing: true},
+		{name: "nothing", missing: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "ring-state.json")
+			if test.primary != nil {
+				if err := ioutil.WriteFile(filename, []byte(*test.primary), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.backup != nil {
+				if err := ioutil.WriteFile(backupFilename(filename), []byte(*test.backup), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			content, err := readWithBackup(filename)
+			switch {
+			case test.missing:
+				if !os.IsNotExist(err) {
+					t.Errorf("Expected the file to be missing, got %q, %v", content, err)
+				}
+			case test.fails:
+				if err == nil || os.IsNotExist(err) {
+					t.Errorf("Expected a parse failure, got %q, %v", content, err)
+				}
+			case err != nil:
+				t.Errorf("Unexpected error: %v", err)
+			case content != test.content:
+				t.Errorf("Expected %q, got %q", test.content, content)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
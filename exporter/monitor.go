@@ -1,19 +1,28 @@
 package exporter
 
 import (
+	"context"
+	"fmt"
 	"github.com/cheezypoofs/ring-exporter/ringapi"
 	ring_types "github.com/cheezypoofs/ring-exporter/ringapi/types"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
+	// minimum time between attempts to re-authenticate
+	reauthBackoff = 15 * time.Minute
+
 	doorbotType      = "doorbot"
 	chimeType        = "chime"
+	accountLabel     = "account"
 	descriptionLabel = "description"
 	typeLabel        = "type"
 )
@@ -26,93 +35,287 @@ func sanitizeLabelValue(s string) string {
 	return s
 }
 
+// Account is one Ring account watched by the Monitor.
+type Account struct {
+	Name string
+	// Config is the config as seen by this account (see `Config.ForAccount`).
+	// It's replaced under sessionLock when reloading.
+	Config       *Config
+	StateHandler *RingStateHandler
+
+	// sessionLock is only held to swap the session or authenticator, never
+	// while authorizing
+	sessionLock sync.Mutex
+	session     *ringapi.AuthorizedSession
+	// authenticator, if set, is used to authorize a new token when the
+	// current one is rejected
+	authenticator    ringapi.Authenticator
+	lastReauth       time.Time
+	reauthenticating bool
+
+	// healthMarks are only used by the poll
+	healthMarks map[uint32]healthMark
+
+	statusLock  sync.Mutex
+	lastPoll    time.Time
+	lastSuccess time.Time
+	lastError   string
+	tokenValid  bool
+	devices     []DeviceSnapshot
+}
+
+// DeviceSnapshot is what the last poll learned about a device.
+type DeviceSnapshot struct {
+	Account     string                   `json:"account"`
+	Id          uint32                   `json:"id"`
+	Description string                   `json:"description"`
+	Type        string                   `json:"type"`
+	Health      *ring_types.DeviceHealth `json:"health,omitempty"`
+	HealthError string                   `json:"health_error,omitempty"`
+	UpdatedAt   time.Time                `json:"updated_at"`
+}
+
 // Monitor performs the ringapi query calls and population into prometheus metrics
 type Monitor struct {
-	StateHandler *RingStateHandler
-	Session      *ringapi.AuthorizedSession
-	Config       *Config
+	Config   *Config
+	Accounts []*Account
 
-	batteryLevel *prometheus.GaugeVec
-	wifiSignal   *prometheus.GaugeVec
-	dingsCount   *prometheus.GaugeVec
+	// cfgFile is what relative paths in the config are relative to
+	cfgFile string
+
+	*deviceMetrics
+	authValid *prometheus.GaugeVec
+
+	reloadSuccess   prometheus.Gauge
+	reloadTimestamp prometheus.Gauge
+
+	stream  *eventBroker
+	started time.Time
+
+	// reauths tracks the accounts re-authenticating in the background
+	reauths sync.WaitGroup
 }
 
-// NewMonitor creates a new Monitor instance with the required parameters
-func NewMonitor(cfgFile string, metrics *prometheus.Registry) (*Monitor, error) {
+// NewMonitor creates a new Monitor instance with the required parameters. Each
+// account must already have a token.
+func NewMonitor(cfgFile string, cfg *Config, accounts []*Account, metrics *prometheus.Registry) (*Monitor, error) {
 
-	cfg, err := LoadConfig(cfgFile)
-	if err != nil {
-		return nil, err
+	// The dings already in the state count as streamed
+	var lastDing int64
+	for _, account := range accounts {
+		session, err := ringapi.OpenAuthorizedSession(account.Config.ApiConfig, account.StateHandler, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to open session for account %s", account.Name)
+		}
+		account.session = session
+
+		if account.authenticator, err = newReauthenticator(cfgFile, account.Config.AuthConfig); err != nil {
+			return nil, errors.Wrapf(err, "Failed to set up re-authentication for account %s", account.Name)
+		}
+
+		if id := account.StateHandler.LatestEventId(); id > lastDing {
+			lastDing = id
+		}
 	}
 
-	stateHandler := NewRingStateHandler(cfgFile)
+	monitor := &Monitor{
+		Config:        cfg,
+		Accounts:      accounts,
+		cfgFile:       cfgFile,
+		deviceMetrics: newDeviceMetrics(),
+		stream:        newEventBroker(lastDing),
+		started:       time.Now(),
+		authValid: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ring_auth_valid",
+			Help: "Whether the token was accepted on the last poll",
+		}, []string{accountLabel}),
+		// These mirror prometheus' own prometheus_config_last_reload_* metrics
+		reloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ring_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}),
+		reloadTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ring_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload",
+		}),
+	}
+
+	// Loading the config at startup counts as the first reload
+	monitor.reloadSuccess.Set(1)
+	monitor.reloadTimestamp.SetToCurrentTime()
 
-	session, err := ringapi.OpenAuthorizedSession(cfg.ApiConfig, stateHandler, nil)
+	monitor.deviceMetrics.register(metrics)
+	metrics.MustRegister(monitor.authValid)
+	metrics.MustRegister(monitor.reloadSuccess)
+	metrics.MustRegister(monitor.reloadTimestamp)
+
+	for _, account := range accounts {
+		stateHandler := account.StateHandler
+		metrics.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "ring_exporter_state_save_failures_total",
+			Help:        "Number of times persisting the state has failed",
+			ConstLabels: prometheus.Labels{accountLabel: account.Name},
+		}, func() float64 {
+			return float64(stateHandler.SaveFailures())
+		}))
+	}
+
+	return monitor, nil
+}
+
+// accountReload is what reloading changes about an account.
+type accountReload struct {
+	account *Account
+	cfg     *Config
+	// session is nil unless the api_config changed
+	session *ringapi.AuthorizedSession
+	// authenticator is only replaced if the auth_config changed
+	authChanged   bool
+	authenticator ringapi.Authenticator
+}
+
+// Reload replaces the config with the result of `load`. If loading fails the
+// current config is kept. Either way the outcome is reflected in the reload metrics.
+// A changed api_config or auth_config takes effect through a new session or
+// authenticator, using the token already in the state.
+func (m *Monitor) Reload(load func() (*Config, error)) error {
+	cfg, err := load()
 	if err != nil {
-		return nil, err
+		m.reloadSuccess.Set(0)
+		return err
 	}
 
-	monitor := &Monitor{
-		StateHandler: stateHandler,
-		Session:      session,
-		Config:       cfg,
+	if cfg.WebConfig != m.Config.WebConfig {
+		log.Printf("Changes to web_config require a restart to take effect")
+	}
+	if strings.Join(cfg.AccountNames(), ",") != strings.Join(m.Config.AccountNames(), ",") {
+		log.Printf("Adding or removing accounts requires a restart to take effect")
+	}
+
+	// Prepare everything first so that a failure keeps the current config
+	var reloads []accountReload
+	for _, account := range m.Accounts {
+		accountCfg, err := cfg.ForAccount(account.Name)
+		if err != nil {
+			// Removed. Keep going with what we had until restarted.
+			continue
+		}
+		account.StateHandler.EnsureHardwareId(&accountCfg.ApiConfig)
+
+		account.sessionLock.Lock()
+		current := account.Config
+		account.sessionLock.Unlock()
+
+		reload := accountReload{account: account, cfg: accountCfg}
+		if accountCfg.StateConfig != current.StateConfig {
+			log.Printf("Changes to the state_config of account %s require a restart to take effect", account.Name)
+		}
+		if accountCfg.ApiConfig != current.ApiConfig {
+			if reload.session, err = ringapi.OpenAuthorizedSession(accountCfg.ApiConfig, account.StateHandler, nil); err != nil {
+				m.reloadSuccess.Set(0)
+				return errors.Wrapf(err, "Failed to open session for account %s", account.Name)
+			}
+		}
+		if accountCfg.AuthConfig != current.AuthConfig {
+			reload.authChanged = true
+			if reload.authenticator, err = newReauthenticator(m.cfgFile, accountCfg.AuthConfig); err != nil {
+				m.reloadSuccess.Set(0)
+				return errors.Wrapf(err, "Failed to set up re-authentication for account %s", account.Name)
+			}
+		}
+		reloads = append(reloads, reload)
+	}
+
+	for _, reload := range reloads {
+		account := reload.account
+		account.sessionLock.Lock()
+		account.Config = reload.cfg
+		if reload.session != nil {
+			account.session = reload.session
+		}
+		if reload.authChanged {
+			account.authenticator = reload.authenticator
+		}
+		account.sessionLock.Unlock()
+	}
+
+	m.Config = cfg
+	m.reloadSuccess.Set(1)
+	m.reloadTimestamp.SetToCurrentTime()
+	return nil
+}
+
+// deviceMetrics are the metrics about the devices themselves.
+type deviceMetrics struct {
+	batteryLevel *prometheus.GaugeVec
+	wifiSignal   *prometheus.GaugeVec
+	dingsCount   *prometheus.GaugeVec
+}
+
+func newDeviceMetrics() *deviceMetrics {
+	deviceLabels := []string{
+		accountLabel,
+		descriptionLabel,
+		typeLabel,
+	}
+
+	return &deviceMetrics{
 		batteryLevel: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ring_device_battery_pct",
 			Help: "Device battery level (percent)",
-		}, []string{
-			descriptionLabel,
-			typeLabel,
-		}),
+		}, deviceLabels),
 		wifiSignal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ring_device_wifi_strength_dbm",
 			Help: "Latest wifi strength reading (-dBm)",
-		}, []string{
-			descriptionLabel,
-			typeLabel,
-		}),
+		}, deviceLabels),
 		// It's a counter, but we're explicitly sampling a value we best-effort count and persist ourselves
 		// so it's really more like a gauge of a counter we don't control.
 		dingsCount: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "ring_device_dings_total",
 			Help: "Best-effort count of total dings",
-		}, []string{
-			descriptionLabel,
-			typeLabel,
-		}),
+		}, deviceLabels),
 	}
+}
 
-	metrics.MustRegister(monitor.batteryLevel)
-	metrics.MustRegister(monitor.wifiSignal)
-	metrics.MustRegister(monitor.dingsCount)
-
-	return monitor, nil
+func (m *deviceMetrics) register(metrics *prometheus.Registry) {
+	metrics.MustRegister(m.batteryLevel)
+	metrics.MustRegister(m.wifiSignal)
+	metrics.MustRegister(m.dingsCount)
 }
 
-func (m *Monitor) updateDingMetrics(device *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) {
-	curCount, err := m.StateHandler.UpdateDingCount(device, dings)
+// updateDingMetrics returns the dings that hadn't been counted before.
+func (m *deviceMetrics) updateDingMetrics(account *Account, device *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) []DingEvent {
+	curCount, newDings, err := account.StateHandler.UpdateDingCount(device, dings)
 
 	if err != nil {
-		return
+		return nil
 	}
 
+	m.setDingCount(account, device, curCount)
+	return newDings
+}
+
+func (m *deviceMetrics) setDingCount(account *Account, device *ring_types.DoorBot, curCount uint32) {
 	m.dingsCount.With(prometheus.Labels{
+		"account":     account.Name,
 		"description": sanitizeLabelValue(device.Description),
 		"type":        doorbotType,
 	}).Set(float64(curCount))
 	log.Printf("Device %s has current ding count %d", device.Description, curCount)
 }
 
-func (m *Monitor) updateDeviceMetrics(description string, health *ring_types.DeviceHealth, typ string) {
+func (m *deviceMetrics) updateDeviceMetrics(account *Account, description string, health *ring_types.DeviceHealth, typ string) {
 
 	// Let's get battery level
 	if health.BatteryPercentage != nil {
 		bl := m.batteryLevel.With(prometheus.Labels{
+			"account":     account.Name,
 			"description": sanitizeLabelValue(description),
 			"type":        typ,
 		})
 		f, err := strconv.ParseFloat(*health.BatteryPercentage, 64)
 		if err != nil {
-			log.Printf("Skipping %s due to failure parsing battery pct '%s'", description, health.BatteryPercentage)
+			log.Printf("Skipping %s due to failure parsing battery pct '%s'", description, *health.BatteryPercentage)
 			bl.Set(math.NaN())
 		} else {
 			log.Printf("Device %s has battery pct %f", description, f)
@@ -123,6 +326,7 @@ func (m *Monitor) updateDeviceMetrics(description string, health *ring_types.Dev
 	// And some wifi stats
 	if health.LatestSignalStrength != nil {
 		ws := m.wifiSignal.With(prometheus.Labels{
+			"account":     account.Name,
 			"description": sanitizeLabelValue(description),
 			"type":        typ,
 		})
@@ -131,41 +335,349 @@ func (m *Monitor) updateDeviceMetrics(description string, health *ring_types.Dev
 	}
 }
 
-// PollOnce performs the API queries and metrics updates
-func (m *Monitor) PollOnce() error {
+// dingsToPublish returns the dings to stream. Those from before the monitor
+// started (such as the history of a device seen for the first time) are only
+// counted, though they're replayed to subscribers reconnecting from before.
+func (m *Monitor) dingsToPublish(account *Account, dings []DingEvent) []StreamEvent {
+	var events []StreamEvent
+	for _, ding := range dings {
+		if ding.CreatedAt.Before(m.started) {
+			continue
+		}
+		events = append(events, dingStreamEvent(account, ding))
+	}
+	return events
+}
+
+func batteryPercent(snapshot *DeviceSnapshot) (float64, bool) {
+	if snapshot.Health == nil || snapshot.Health.BatteryPercentage == nil {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(*snapshot.Health.BatteryPercentage, 64)
+	return f, err == nil
+}
+
+// healthMark is the last known battery level and firmware of a device.
+type healthMark struct {
+	battery    float64
+	hasBattery bool
+	firmware   string
+}
+
+// publishHealthChanges streams the batteries crossing the low threshold and
+// firmware changes. They're compared with what was last known, so a poll
+// which failed to get the health in between doesn't hide a change.
+func (m *Monitor) publishHealthChanges(account *Account, snapshots []DeviceSnapshot) {
+	// A threshold of zero turns battery events off
+	var threshold float64
+	if m.Config.BatteryLowPercent != nil {
+		threshold = float64(*m.Config.BatteryLowPercent)
+	}
+
+	if account.healthMarks == nil {
+		account.healthMarks = map[uint32]healthMark{}
+	}
+
+	for i := range snapshots {
+		current := &snapshots[i]
+		if current.Health == nil {
+			continue
+		}
+		mark, known := account.healthMarks[current.Id]
+
+		event := StreamEvent{
+			Account:     account.Name,
+			DeviceId:    current.Id,
+			Description: current.Description,
+			Time:        current.UpdatedAt,
+		}
+
+		if pct, ok := batteryPercent(current); ok {
+			if known && mark.hasBattery && threshold > 0 {
+				battery := event
+				battery.BatteryPercent = &pct
+				if mark.battery >= threshold && pct < threshold {
+					battery.Type = BatteryLowStreamEvent
+					m.stream.publish(battery)
+				} else if mark.battery < threshold && pct >= threshold {
+					battery.Type = BatteryOkStreamEvent
+					m.stream.publish(battery)
+				}
+			}
+			mark.battery, mark.hasBattery = pct, true
+		}
+
+		if firmware := current.Health.Firmware; firmware != "" {
+			if known && mark.firmware != "" && firmware != mark.firmware {
+				changed := event
+				changed.Type = FirmwareStreamEvent
+				changed.Firmware = firmware
+				changed.PreviousFirmware = mark.firmware
+				m.stream.publish(changed)
+			}
+			mark.firmware = firmware
+		}
+
+		account.healthMarks[current.Id] = mark
+	}
+}
+
+// Session returns the current session. It may be replaced when re-authenticating.
+func (a *Account) Session() *ringapi.AuthorizedSession {
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+	return a.session
+}
 
-	devices, err := m.Session.GetDevices()
+// Reauthenticating returns whether a new token is being authorized for the
+// account. It isn't polled meanwhile.
+func (a *Account) Reauthenticating() bool {
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+	return a.reauthenticating
+}
+
+// startReauthenticate authorizes a new token for `account` in the background
+// since that may wait a long time on a 2FA code. The current session (and the
+// stored token) stay in place until it's done. Cancelling `ctx` gives up. An
+// error is returned if it can't be started.
+func (m *Monitor) startReauthenticate(ctx context.Context, account *Account) error {
+	account.sessionLock.Lock()
+	defer account.sessionLock.Unlock()
+
+	if account.reauthenticating {
+		return nil
+	}
+	if account.authenticator == nil {
+		return fmt.Errorf("No authenticator is configured. Run `init` to authorize a new token")
+	}
+	// Don't hammer the API (or wait on 2FA codes) every poll
+	if time.Since(account.lastReauth) < reauthBackoff {
+		next := account.lastReauth.Add(reauthBackoff)
+		return fmt.Errorf("Re-authenticated too recently, will try again after %s", next.Format(time.RFC3339))
+	}
+	account.lastReauth = time.Now()
+	account.reauthenticating = true
+
+	log.Printf("Token for account %s was rejected, re-authenticating", account.Name)
+
+	authenticator := account.authenticator
+	m.reauths.Add(1)
+	go func() {
+		defer m.reauths.Done()
+
+		err := account.reauthenticate(ctx, authenticator)
+
+		account.sessionLock.Lock()
+		account.reauthenticating = false
+		account.sessionLock.Unlock()
+
+		if err != nil {
+			log.Printf("Failed to re-authenticate account %s: %v", account.Name, err)
+		} else {
+			log.Printf("Re-authenticated account %s", account.Name)
+		}
+	}()
+	return nil
+}
+
+// reauthenticate replaces the session with one for a token newly authorized
+// with `authenticator`.
+func (a *Account) reauthenticate(ctx context.Context, authenticator ringapi.Authenticator) error {
+	token, err := ringapi.AuthorizeToken(ctx, authenticator)
+	if err != nil {
+		return err
+	}
+
+	// Only now is the rejected token replaced
+	a.StateHandler.StoreToken(token)
+
+	// The api_config may have been reloaded meanwhile
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+	session, err := ringapi.OpenAuthorizedSession(a.Config.ApiConfig, a.StateHandler, nil)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to retrieve device info")
+		return err
 	}
+	a.session = session
+	return nil
+}
+
+// WaitReauthentications waits for the accounts re-authenticating in the
+// background to be done, such as after cancelling the context of the polls.
+func (m *Monitor) WaitReauthentications() {
+	m.reauths.Wait()
+}
+
+// recordPoll keeps track of the outcome of polling for `Monitor.Ready` and
+// the status API.
+func (a *Account) recordPoll(err error) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+
+	a.lastPoll = time.Now()
+	if err == nil {
+		a.lastSuccess = a.lastPoll
+		a.lastError = ""
+		a.tokenValid = true
+	} else {
+		a.lastError = err.Error()
+		if ringapi.IsUnauthorized(err) {
+			a.tokenValid = false
+		}
+	}
+}
+
+func (a *Account) setDevices(devices []DeviceSnapshot) {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	a.devices = devices
+}
+
+// Devices returns the devices seen by the last successful poll.
+func (a *Account) Devices() []DeviceSnapshot {
+	a.statusLock.Lock()
+	defer a.statusLock.Unlock()
+	return append([]DeviceSnapshot(nil), a.devices...)
+}
+
+// Ready returns an error unless every account has been polled successfully
+// and its token hasn't since been rejected.
+func (m *Monitor) Ready() error {
+	for _, account := range m.Accounts {
+		account.statusLock.Lock()
+		polled, tokenValid := !account.lastSuccess.IsZero(), account.tokenValid
+		account.statusLock.Unlock()
+
+		if !polled {
+			return fmt.Errorf("Account %s hasn't been polled successfully yet", account.Name)
+		}
+		if !tokenValid {
+			return fmt.Errorf("The token of account %s was rejected", account.Name)
+		}
+	}
+	return nil
+}
+
+// Save persists the state of every account. It returns the first failure.
+func (m *Monitor) Save() error {
+	var firstErr error
+	for _, account := range m.Accounts {
+		if err := account.StateHandler.Save(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// PollOnce performs the API queries and metrics updates for every account.
+// Cancelling `ctx` aborts any API calls in flight, and any re-authentication
+// it starts. A failure with one account doesn't stop the others from being
+// polled. Accounts being re-authenticated are skipped.
+func (m *Monitor) PollOnce(ctx context.Context) error {
+	var failures []string
+	var dings []StreamEvent
+	for _, account := range m.Accounts {
+		if account.Reauthenticating() {
+			failures = append(failures, fmt.Sprintf("account %s: skipped while re-authenticating", account.Name))
+			continue
+		}
+
+		accountDings, err := m.pollAccount(ctx, account)
+		account.recordPoll(err)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("account %s: %v", account.Name, err))
+		}
+		dings = append(dings, accountDings...)
+	}
+
+	// Subscribers resume from the newest ding they saw, so they must be
+	// streamed in the order of their ids
+	sort.SliceStable(dings, func(i, j int) bool {
+		return dings[i].Ding.Id < dings[j].Ding.Id
+	})
+	for _, ding := range dings {
+		m.stream.publish(ding)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// pollAccount returns the dings to stream. Any health changes are streamed already.
+func (m *Monitor) pollAccount(ctx context.Context, account *Account) ([]StreamEvent, error) {
+	authValid := m.authValid.With(prometheus.Labels{accountLabel: account.Name})
+
+	devices, err := account.Session().WithContext(ctx).GetDevices()
+	if err != nil && ringapi.IsUnauthorized(err) {
+		authValid.Set(0)
+		if rErr := m.startReauthenticate(ctx, account); rErr != nil {
+			return nil, errors.Wrapf(err, "Token rejected (%v)", rErr)
+		}
+		return nil, errors.Wrapf(err, "Token rejected, re-authenticating in the background")
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve device info")
+	}
+	authValid.Set(1)
+
+	session := account.Session().WithContext(ctx)
+	var snapshots []DeviceSnapshot
+	var dings []StreamEvent
 
 	for _, device := range devices.DoorBots {
+		snapshot := DeviceSnapshot{
+			Account:     account.Name,
+			Id:          device.Id,
+			Description: device.Description,
+			Type:        doorbotType,
+			UpdatedAt:   time.Now(),
+		}
 
 		// Get the health. It has more details
-		hr, err := m.Session.GetDoorBotHealth(&device)
+		hr, err := session.GetDoorBotHealth(&device)
 		if err != nil {
 			log.Printf("Skipping %s because of failed health fetch: %v", device.Description, err)
+			snapshot.HealthError = err.Error()
+			snapshots = append(snapshots, snapshot)
 			continue
 		}
-		m.updateDeviceMetrics(device.Description, &hr.DeviceHealth, doorbotType)
+		snapshot.Health = &hr.DeviceHealth
+		snapshots = append(snapshots, snapshot)
+		m.updateDeviceMetrics(account, device.Description, &hr.DeviceHealth, doorbotType)
 
-		dings, err := m.Session.GetDoorBotHistory(&device)
+		history, err := session.GetDoorBotHistory(&device)
 		if err == nil {
-			m.updateDingMetrics(&device, &dings)
+			dings = append(dings, m.dingsToPublish(account, m.updateDingMetrics(account, &device, &history))...)
 		}
 	}
 
 	for _, device := range devices.Chimes {
+		snapshot := DeviceSnapshot{
+			Account:     account.Name,
+			Id:          device.Id,
+			Description: device.Description,
+			Type:        chimeType,
+			UpdatedAt:   time.Now(),
+		}
 
 		// Get the health. It has more details
-		cr, err := m.Session.GetChimeHealth(&device)
+		cr, err := session.GetChimeHealth(&device)
 		if err != nil {
 			log.Printf("Skipping %s because of failed health fetch: %v", device.Description, err)
+			snapshot.HealthError = err.Error()
+			snapshots = append(snapshots, snapshot)
 			continue
 		}
+		snapshot.Health = &cr.DeviceHealth
+		snapshots = append(snapshots, snapshot)
 
-		m.updateDeviceMetrics(device.Description, &cr.DeviceHealth, chimeType)
+		m.updateDeviceMetrics(account, device.Description, &cr.DeviceHealth, chimeType)
 	}
 
-	return nil
+	m.publishHealthChanges(account, snapshots)
+	account.setDevices(snapshots)
+	return dings, nil
 }
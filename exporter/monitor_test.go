@@ -0,0 +1,146 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"testing"
+)
+
+func newTestMonitor(t *testing.T, cfg *Config) *Monitor {
+	t.Helper()
+	EnsureConfigDefaults(cfg)
+
+	handler := newTestStateHandler(t, NewMemoryStateBackend(), nil)
+	handler.StoreToken(testToken())
+
+	accountCfg, err := cfg.ForAccount(DefaultAccount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts := []*Account{{Name: DefaultAccount, Config: accountCfg, StateHandler: handler}}
+
+	m, err := NewMonitor("", cfg, accounts, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestMonitorReload(t *testing.T) {
+	m := newTestMonitor(t, &Config{})
+	account := m.Accounts[0]
+	session := account.Session()
+	if account.authenticator != nil {
+		t.Fatalf("Expected no authenticator without auth_config.reauthenticate")
+	}
+
+	reload := func(edit func(cfg *Config)) error {
+		return m.Reload(func() (*Config, error) {
+			cfg := *m.Config
+			edit(&cfg)
+			return &cfg, nil
+		})
+	}
+
+	// Nothing about the account changed
+	if err := reload(func(cfg *Config) { cfg.PollIntervalSeconds = 60 }); err != nil {
+		t.Fatal(err)
+	}
+	if m.Config.PollIntervalSeconds != 60 || account.Session() != session {
+		t.Errorf("Expected only the poll interval to change")
+	}
+
+	if err := reload(func(cfg *Config) { cfg.ApiConfig.HardwareId = "reloaded" }); err != nil {
+		t.Fatal(err)
+	}
+	if account.Config.ApiConfig.HardwareId != "reloaded" || account.Session() == session {
+		t.Errorf("Expected a new session for the new api_config")
+	}
+	session = account.Session()
+
+	if err := reload(func(cfg *Config) {
+		cfg.AuthConfig.Method = EnvAuthMethod
+		cfg.AuthConfig.Reauthenticate = true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := account.authenticator.(*EnvAuthenticator); !ok {
+		t.Errorf("Expected the env authenticator, got %T", account.authenticator)
+	}
+
+	// A bad auth_config keeps everything as it was
+	err := reload(func(cfg *Config) {
+		cfg.PollIntervalSeconds = 120
+		cfg.ApiConfig.HardwareId = "bad"
+		cfg.AuthConfig.Method = FileAuthMethod
+	})
+	if err == nil {
+		t.Fatalf("Expected the file auth method without files to fail")
+	}
+	if m.Config.PollIntervalSeconds != 60 || account.Config.ApiConfig.HardwareId != "reloaded" || account.Session() != session {
+		t.Errorf("Expected the config and session to be kept")
+	}
+	if _, ok := account.authenticator.(*EnvAuthenticator); !ok {
+		t.Errorf("Expected the env authenticator to be kept, got %T", account.authenticator)
+	}
+
+	// As is a config that fails to load
+	if err = m.Reload(func() (*Config, error) { return nil, fmt.Errorf("broken") }); err == nil {
+		t.Errorf("Expected the failure to load to be returned")
+	}
+}
+
+// blockingAuthenticator waits to be released (or cancelled) for the credentials.
+type blockingAuthenticator struct {
+	release chan struct{}
+}
+
+func (a *blockingAuthenticator) PromptCredentials() (string, string, error) {
+	<-a.release
+	return "", "", fmt.Errorf("no credentials")
+}
+
+func (a *blockingAuthenticator) Prompt2FACode(ctx context.Context, challenge *ringapi.LoginChallenge) (string, error) {
+	return "", fmt.Errorf("no code")
+}
+
+func TestReauthenticateInBackground(t *testing.T) {
+	m := newTestMonitor(t, &Config{})
+	account := m.Accounts[0]
+	session := account.Session()
+
+	if err := m.startReauthenticate(context.Background(), account); err == nil {
+		t.Errorf("Expected re-authenticating without an authenticator to fail")
+	}
+
+	authenticator := &blockingAuthenticator{release: make(chan struct{})}
+	account.authenticator = authenticator
+
+	// This returns while the authenticator is still waiting
+	if err := m.startReauthenticate(context.Background(), account); err != nil {
+		t.Fatal(err)
+	}
+	if !account.Reauthenticating() {
+		t.Errorf("Expected the account to be re-authenticating")
+	}
+
+	// The account is skipped rather than polled meanwhile
+	err := m.PollOnce(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "skipped while re-authenticating") {
+		t.Errorf("Expected the account to be skipped, got %v", err)
+	}
+
+	close(authenticator.release)
+	m.WaitReauthentications()
+	if account.Reauthenticating() || account.Session() != session {
+		t.Errorf("Expected the failed attempt to be over and the session kept")
+	}
+
+	// Attempts are spaced out
+	if err = m.startReauthenticate(context.Background(), account); err == nil || !strings.Contains(err.Error(), "too recently") {
+		t.Errorf("Expected to have to wait before trying again, got %v", err)
+	}
+}
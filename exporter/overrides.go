@@ -0,0 +1,159 @@
+package exporter
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OverrideEnvPrefix is the prefix of every environment variable that overrides the config.
+const OverrideEnvPrefix = "RING_EXPORTER_"
+
+// OverrideField describes a config item that can be overridden outside of the
+// config file. `Name` is suitable as a commandline flag and `Env` is the name
+// of the environment variable.
+type OverrideField struct {
+	Name string
+	Env  string
+	Help string
+
+	apply func(cfg *Config, value string) error
+}
+
+func overrideField(name string, help string, apply func(cfg *Config, value string) error) OverrideField {
+	env := OverrideEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+	return OverrideField{
+		Name:  name,
+		Env:   env,
+		Help:  help,
+		apply: apply,
+	}
+}
+
+func overrideString(field func(cfg *Config) *string) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		*field(cfg) = value
+		return nil
+	}
+}
+
+func overrideBool(field func(cfg *Config) *bool) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = v
+		return nil
+	}
+}
+
+func overrideUint32(field func(cfg *Config) *uint32) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		v, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		*field(cfg) = uint32(v)
+		return nil
+	}
+}
+
+func overrideOptionalUint32(field func(cfg *Config) **uint32) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		v, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return err
+		}
+		// A new value rather than writing through a pointer shared with another config
+		u := uint32(v)
+		*field(cfg) = &u
+		return nil
+	}
+}
+
+// overrideSeconds accepts either a positive number of seconds or a duration such as `5m`.
+func overrideSeconds(field func(cfg *Config) *uint32) func(*Config, string) error {
+	return func(cfg *Config, value string) error {
+		var seconds int64
+		if v, err := strconv.ParseInt(value, 10, 64); err == nil {
+			seconds = v
+		} else {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			if d > 0 && d < time.Second {
+				return fmt.Errorf("%s is less than a second", d)
+			}
+			seconds = int64(d / time.Second)
+		}
+
+		if seconds <= 0 {
+			return fmt.Errorf("must be positive")
+		}
+		if seconds > math.MaxUint32 {
+			return fmt.Errorf("must be at most %d seconds", uint32(math.MaxUint32))
+		}
+		*field(cfg) = uint32(seconds)
+		return nil
+	}
+}
+
+// OverrideFields lists every config item that can be overridden.
+var OverrideFields = []OverrideField{
+	overrideField("api.hardware-id", "Hardware id identifying this client to Ring (api_config.hardware_id)",
+		overrideString(func(cfg *Config) *string { return &cfg.ApiConfig.HardwareId })),
+	overrideField("web.listen-address", "Address to expose metrics on, host:port or unix:/path. Takes precedence over the port (web_config.listen_address)",
+		overrideString(func(cfg *Config) *string { return &cfg.WebConfig.ListenAddress })),
+	overrideField("web.port", "Port to expose metrics on (web_config.port)",
+		overrideUint32(func(cfg *Config) *uint32 { return &cfg.WebConfig.Port })),
+	overrideField("web.metrics-route", "Path to expose metrics on (web_config.metrics_route)",
+		overrideString(func(cfg *Config) *string { return &cfg.WebConfig.MetricsRoute })),
+	overrideField("web.config.file", "TLS and basic auth config in the exporter-toolkit format (web_config.config_file)",
+		overrideString(func(cfg *Config) *string { return &cfg.WebConfig.ConfigFile })),
+	overrideField("state.backend", "Where to keep the state: file, bolt or memory (state_config.backend)",
+		overrideString(func(cfg *Config) *string { return &cfg.StateConfig.Backend })),
+	overrideField("state.path", "State file or database, relative to the config file (state_config.path)",
+		overrideString(func(cfg *Config) *string { return &cfg.StateConfig.Path })),
+	overrideField("state.key-file", "File holding the passphrase to encrypt the token with (state_config.key_file)",
+		overrideString(func(cfg *Config) *string { return &cfg.StateConfig.KeyFile })),
+	overrideField("auth.method", "How to obtain credentials when authorizing: cli, env, file or stdin (auth_config.method)",
+		overrideString(func(cfg *Config) *string { return &cfg.AuthConfig.Method })),
+	overrideField("auth.username-file", "File holding the username for the file auth method (auth_config.username_file)",
+		overrideString(func(cfg *Config) *string { return &cfg.AuthConfig.UsernameFile })),
+	overrideField("auth.password-file", "File holding the password for the file auth method (auth_config.password_file)",
+		overrideString(func(cfg *Config) *string { return &cfg.AuthConfig.PasswordFile })),
+	overrideField("auth.code-file", "File or named pipe to wait on for the 2FA code (auth_config.code_file)",
+		overrideString(func(cfg *Config) *string { return &cfg.AuthConfig.CodeFile })),
+	overrideField("auth.code-timeout", "Seconds (or a duration) to wait for the 2FA code in the code file (auth_config.code_timeout_seconds)",
+		overrideSeconds(func(cfg *Config) *uint32 { return &cfg.AuthConfig.CodeTimeoutSeconds })),
+	overrideField("auth.reauthenticate", "Authorize a new token with the env or file method when the current one is rejected (auth_config.reauthenticate)",
+		overrideBool(func(cfg *Config) *bool { return &cfg.AuthConfig.Reauthenticate })),
+	overrideField("poll.interval", "Seconds (or a duration) between polls of the API (poll_interval_seconds)",
+		overrideSeconds(func(cfg *Config) *uint32 { return &cfg.PollIntervalSeconds })),
+	overrideField("save.interval", "Seconds (or a duration) between saves of the state (save_interval_seconds)",
+		overrideSeconds(func(cfg *Config) *uint32 { return &cfg.SaveIntervalSeconds })),
+	overrideField("battery.low-percent", "Battery level below which the event stream reports a low battery. 0 turns that off (battery_low_percent)",
+		overrideOptionalUint32(func(cfg *Config) **uint32 { return &cfg.BatteryLowPercent })),
+}
+
+// ConfigOverrides maps `OverrideField.Name` to a value that takes precedence
+// over the config file and defaults.
+type ConfigOverrides map[string]string
+
+// Apply imposes the overrides on `cfg`. Empty values are ignored.
+func (o ConfigOverrides) Apply(cfg *Config) error {
+	for _, field := range OverrideFields {
+		value, ok := o[field.Name]
+		if !ok || value == "" {
+			continue
+		}
+		if err := field.apply(cfg, value); err != nil {
+			return fmt.Errorf("Invalid value '%s' for %s: %v", value, field.Name, err)
+		}
+	}
+	return nil
+}
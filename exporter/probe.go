@@ -0,0 +1,143 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// MatchesDevice returns true if `selector` names the device by id or description.
+// An empty selector matches everything.
+func MatchesDevice(selector string, id uint32, description string) bool {
+	if selector == "" {
+		return true
+	}
+	if selector == description {
+		return true
+	}
+	return selector == strconv.FormatUint(uint64(id), 10)
+}
+
+// ProbeHandler serves the metrics of a single device, fetched on demand, in
+// the style of the blackbox exporter. The device is picked with the `device`
+// parameter (id or description) and the `account` parameter, which defaults
+// to the default account.
+func (m *Monitor) ProbeHandler() http.Handler {
+	return http.HandlerFunc(m.handleProbe)
+}
+
+func (m *Monitor) account(name string) *Account {
+	for _, account := range m.Accounts {
+		if account.Name == name {
+			return account
+		}
+	}
+	return nil
+}
+
+func (m *Monitor) handleProbe(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	selector := params.Get("device")
+	if selector == "" {
+		http.Error(w, "The device parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	accountName := params.Get("account")
+	if accountName == "" {
+		accountName = DefaultAccount
+	}
+	account := m.account(accountName)
+	if account == nil {
+		http.Error(w, fmt.Sprintf("Unknown account '%s'", accountName), http.StatusBadRequest)
+		return
+	}
+
+	// Give up before Prometheus does so that at least probe_success is scraped
+	ctx := r.Context()
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		if seconds, err := strconv.ParseFloat(v, 64); err == nil && seconds > 1 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, time.Duration((seconds-0.5)*float64(time.Second)))
+			defer cancel()
+		}
+	}
+
+	probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_success",
+		Help: "Whether the probe succeeded",
+	})
+	probeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "probe_duration_seconds",
+		Help: "How long the probe took",
+	})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probeSuccess)
+	registry.MustRegister(probeDuration)
+	metrics := newDeviceMetrics()
+	metrics.register(registry)
+
+	start := time.Now()
+	if err := m.probeDevice(ctx, account, selector, metrics); err != nil {
+		log.Printf("Probe of %s in account %s failed: %v", selector, account.Name, err)
+	} else {
+		probeSuccess.Set(1)
+	}
+	probeDuration.Set(time.Since(start).Seconds())
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeDevice fetches the health (and history, for doorbots) of the device
+// named by `selector` into `metrics`. The state is left to the poll.
+func (m *Monitor) probeDevice(ctx context.Context, account *Account, selector string, metrics *deviceMetrics) error {
+	session := account.Session().WithContext(ctx)
+
+	devices, err := session.GetDevices()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to retrieve device info")
+	}
+
+	for _, device := range devices.DoorBots {
+		if !MatchesDevice(selector, device.Id, device.Description) {
+			continue
+		}
+
+		hr, err := session.GetDoorBotHealth(&device)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to fetch health")
+		}
+		metrics.updateDeviceMetrics(account, device.Description, &hr.DeviceHealth, doorbotType)
+
+		dings, err := session.GetDoorBotHistory(&device)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to fetch history")
+		}
+		// A probe mustn't move the bookmark, or the poll would miss these dings
+		metrics.setDingCount(account, &device, account.StateHandler.DingCount(&device, &dings))
+		return nil
+	}
+
+	for _, device := range devices.Chimes {
+		if !MatchesDevice(selector, device.Id, device.Description) {
+			continue
+		}
+
+		cr, err := session.GetChimeHealth(&device)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to fetch health")
+		}
+		metrics.updateDeviceMetrics(account, device.Description, &cr.DeviceHealth, chimeType)
+		return nil
+	}
+
+	return fmt.Errorf("No such device")
+}
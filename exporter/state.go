@@ -1,12 +1,14 @@
 package exporter
 
 import (
-	"encoding/json"
-	_ "github.com/cheezypoofs/ring-exporter/ringapi"
+	"fmt"
+	"github.com/cheezypoofs/ring-exporter/ringapi"
 	ring_types "github.com/cheezypoofs/ring-exporter/ringapi/types"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
-	"io/ioutil"
-	"path/filepath"
+	"log"
+	"os"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,30 +19,81 @@ type dingCount struct {
 	LastTimestamp time.Time `json:"last_timestamp"`
 }
 
+// maxEvents bounds how many of the most recent events are kept in the state.
+const maxEvents = 1000
+
+// DingEvent is a ding (or motion or other event) seen by the exporter.
+type DingEvent struct {
+	Id          int64     `json:"id"`
+	DeviceId    uint32    `json:"device_id"`
+	Description string    `json:"description"`
+	Kind        string    `json:"kind"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 // RingState is a serializable object for holding state
 type RingState struct {
 	Token      *oauth2.Token `json:"token"`
 	DingCounts []dingCount   `json:"ding_counts"`
+	// HardwareId is only used when the config doesn't provide one.
+	HardwareId string `json:"hardware_id,omitempty"`
+	// TokenUpdatedAt is when the token was last authorized or refreshed.
+	TokenUpdatedAt time.Time `json:"token_updated_at"`
+	// EncryptedToken replaces Token when persisting with a TokenCipher.
+	EncryptedToken string `json:"encrypted_token,omitempty"`
+	// Events are the most recent events counted, oldest first.
+	Events []DingEvent `json:"events,omitempty"`
 }
 
 // RingStateHandler exposes persistence of the `RingState` and also implements
 // `ringapi.TokenHandler`
 type RingStateHandler struct {
-	filename string
+	backend StateBackend
+	cipher  *TokenCipher
 
-	lock  sync.Mutex
-	state RingState
+	lock         sync.Mutex
+	state        RingState
+	saveFailures uint64
 }
 
-// NewRingStateHandler creates a new RingStateHandler instance
-func NewRingStateHandler(cfgFile string) *RingStateHandler {
-	stateFile := filepath.Join(filepath.Dir(cfgFile), "ring-state.json")
-
+// NewRingStateHandler creates a new RingStateHandler instance which persists
+// to `backend`. If `cipher` is not nil, the token is encrypted at rest.
+func NewRingStateHandler(backend StateBackend, cipher *TokenCipher) (*RingStateHandler, error) {
 	handler := &RingStateHandler{
-		filename: stateFile,
+		backend: backend,
+		cipher:  cipher,
+	}
+	if err := handler.load(); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+// OpenRingStateHandler opens the state backend configured in `cfg` and makes
+// sure the config has a hardware id. If `passphrase` is not empty, the token
+// is encrypted at rest with it.
+func OpenRingStateHandler(cfgFile string, cfg *Config, passphrase []byte) (*RingStateHandler, error) {
+	var cipher *TokenCipher
+	if len(passphrase) > 0 {
+		var err error
+		if cipher, err = NewTokenCipher(passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	backend, err := OpenStateBackend(cfgFile, cfg.StateConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, err := NewRingStateHandler(backend, cipher)
+	if err != nil {
+		backend.Close()
+		return nil, err
 	}
-	handler.load()
-	return handler
+
+	handler.EnsureHardwareId(&cfg.ApiConfig)
+	return handler, nil
 }
 
 // Fetch implements `ringapi.TokenHandler` interface
@@ -51,72 +104,192 @@ func (s *RingStateHandler) FetchToken() *oauth2.Token {
 	return s.state.Token
 }
 
-// Fetch implements `ringapi.TokenHandler` interface
+// StoreToken implements `ringapi.TokenHandler` interface
 func (s *RingStateHandler) StoreToken(token *oauth2.Token) {
 	s.lock.Lock()
 	s.state.Token = token
+	s.state.TokenUpdatedAt = time.Now()
 	s.saveLocked()
 	s.lock.Unlock()
 }
 
+// TokenUpdatedAt returns when the token was last authorized or refreshed. It
+// is zero if that's unknown.
+func (s *RingStateHandler) TokenUpdatedAt() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.state.TokenUpdatedAt
+}
+
+// ClearToken forgets the token and persists that.
+func (s *RingStateHandler) ClearToken() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state.Token = nil
+	s.state.TokenUpdatedAt = time.Time{}
+	return s.saveReplacingBackupLocked()
+}
+
+// EnsureHardwareId fills in a missing hardware id in `config` from the state,
+// generating and persisting a new one if needed. This keeps the hardware id
+// stable when the config file can't be written.
+func (s *RingStateHandler) EnsureHardwareId(config *ringapi.ApiConfig) {
+	if config.HardwareId != "" {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.state.HardwareId == "" {
+		s.state.HardwareId = ringapi.NewHardwareId()
+		s.saveLocked()
+	}
+	config.HardwareId = s.state.HardwareId
+}
+
+// load reads the state from the backend. Having no state yet is not an error.
 func (s *RingStateHandler) load() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	data, err := ioutil.ReadFile(s.filename)
+	state, err := s.backend.Load()
 	if err != nil {
-		return err
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to load state from %s", s.backend)
 	}
 
-	if json.Unmarshal(data, &s.state); err != nil {
-		return err
+	if state.EncryptedToken != "" {
+		if s.cipher == nil {
+			return fmt.Errorf("The token in %s is encrypted. Provide the key with %s or state_config.key_file", s.backend, StateKeyEnv)
+		}
+		if state.Token, err = s.cipher.Open(state.EncryptedToken); err != nil {
+			return err
+		}
+		state.EncryptedToken = ""
 	}
 
+	s.state = *state
 	return nil
 }
 
-func (s *RingStateHandler) Save() {
+// Rekey changes the key the token is encrypted with. A nil `cipher` stores
+// the token in plaintext. The state is saved with the new key.
+func (s *RingStateHandler) Rekey(cipher *TokenCipher) error {
 	s.lock.Lock()
-	s.saveLocked()
-	s.lock.Unlock()
+	defer s.lock.Unlock()
+
+	s.cipher = cipher
+	return s.saveReplacingBackupLocked()
 }
 
-func (s *RingStateHandler) saveLocked() {
-	data, _ := json.MarshalIndent(s.state, "", " ")
-	ioutil.WriteFile(s.filename, data, 0600)
+// Close releases the backend. The state is not saved.
+func (s *RingStateHandler) Close() error {
+	return s.backend.Close()
 }
 
-// UpdateDingCount updates the `RingState` with the historical set of dings and updates
-// the gauge reprsenting the ding counter appropriate. This returns the current count (across restart)
-// for the device as seen by this exporter and state.
-func (s *RingStateHandler) UpdateDingCount(bot *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) (uint32, error) {
+// Save persists the state. Failures are logged and counted as well as returned.
+func (s *RingStateHandler) Save() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.saveLocked()
+}
 
+// SaveFailures returns how many times persisting the state has failed.
+func (s *RingStateHandler) SaveFailures() uint64 {
 	s.lock.Lock()
 	defer s.lock.Unlock()
+	return s.saveFailures
+}
+
+// saveReplacingBackupLocked saves twice so that a backup kept by the backend
+// doesn't still hold the token as it was before.
+func (s *RingStateHandler) saveReplacingBackupLocked() error {
+	if err := s.saveLocked(); err != nil {
+		return err
+	}
+	return s.saveLocked()
+}
 
-	var count *dingCount
+func (s *RingStateHandler) saveLocked() error {
+	state := s.state
+	if s.cipher != nil && state.Token != nil {
+		sealed, err := s.cipher.Seal(state.Token)
+		if err != nil {
+			s.saveFailures++
+			return errors.Wrapf(err, "Failed to encrypt token")
+		}
+		state.Token = nil
+		state.EncryptedToken = sealed
+	}
 
-	// See if we have state already for this device
-	for _, d := range s.state.DingCounts {
-		if d.DeviceId == bot.Id {
-			// grab a reference
-			count = &d
+	if err := s.backend.Save(&state); err != nil {
+		s.saveFailures++
+		log.Printf("Failed to save state to %s: %v", s.backend, err)
+		return errors.Wrapf(err, "Failed to persist state")
+	}
+	return nil
+}
+
+// Events returns the events created after `since`, newest first.
+func (s *RingStateHandler) Events(since time.Time) []DingEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var events []DingEvent
+	for i := len(s.state.Events) - 1; i >= 0; i-- {
+		event := s.state.Events[i]
+		if !event.CreatedAt.After(since) {
 			break
 		}
+		events = append(events, event)
 	}
+	return events
+}
 
-	// Create a new state entry for this device
-	if count == nil {
-		newCount := dingCount{
-			DeviceId: bot.Id,
+// EventsAfter returns the events with an id greater than `id`, oldest first.
+// Ring's ding ids increase over time. `complete` is false if events that may
+// have come after `id` were already dropped to keep the state bounded.
+func (s *RingStateHandler) EventsAfter(id int64) (events []DingEvent, complete bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	complete = len(s.state.Events) < maxEvents
+	for _, event := range s.state.Events {
+		if event.Id > id {
+			events = append(events, event)
+		} else {
+			// Anything dropped came before this one
+			complete = true
+		}
+	}
+	return events, complete
+}
+
+// LatestEventId returns the greatest id of the events kept, or zero if there are none.
+func (s *RingStateHandler) LatestEventId() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var latest int64
+	for _, event := range s.state.Events {
+		if event.Id > latest {
+			latest = event.Id
 		}
-		s.state.DingCounts = append(s.state.DingCounts, newCount)
-		// grab a reference to it
-		count = &s.state.DingCounts[len(s.state.DingCounts)-1]
 	}
+	return latest
+}
 
+// countDings moves `count` forward past the dings after its bookmark,
+// returning the dings that were counted.
+func countDings(count *dingCount, bot *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) []DingEvent {
 	// Keep track of the latest bookmark we have
 	lastTimestamp := count.LastTimestamp
+	var newEvents []DingEvent
 
 	for _, ding := range *dings {
 		ts, err := time.Parse(time.RFC3339, ding.CreatedAt)
@@ -127,6 +300,13 @@ func (s *RingStateHandler) UpdateDingCount(bot *ring_types.DoorBot, dings *[]rin
 		// Count this ding if it's after the last bookmark
 		if ts.After(count.LastTimestamp) {
 			count.MyCounter++
+			newEvents = append(newEvents, DingEvent{
+				Id:          ding.Id,
+				DeviceId:    bot.Id,
+				Description: bot.Description,
+				Kind:        ding.Kind,
+				CreatedAt:   ts,
+			})
 		}
 
 		// Move our bookmark forward to the most recent one we've seen
@@ -137,7 +317,69 @@ func (s *RingStateHandler) UpdateDingCount(bot *ring_types.DoorBot, dings *[]rin
 
 	// Persist the bookmark
 	count.LastTimestamp = lastTimestamp
+	return newEvents
+}
+
+// findDingCountLocked returns the state entry for `bot`, or nil if it has none yet.
+func (s *RingStateHandler) findDingCountLocked(bot *ring_types.DoorBot) *dingCount {
+	for i := range s.state.DingCounts {
+		if s.state.DingCounts[i].DeviceId == bot.Id {
+			// grab a reference (not to a copy, or nothing would be persisted)
+			return &s.state.DingCounts[i]
+		}
+	}
+	return nil
+}
+
+// DingCount returns the count UpdateDingCount would, but leaves the state
+// untouched so that the dings are still new to the next UpdateDingCount.
+func (s *RingStateHandler) DingCount(bot *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) uint32 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	count := dingCount{DeviceId: bot.Id}
+	if stored := s.findDingCountLocked(bot); stored != nil {
+		count = *stored
+	}
+	countDings(&count, bot, dings)
+	return count.MyCounter
+}
+
+// UpdateDingCount updates the `RingState` with the historical set of dings and updates
+// the gauge reprsenting the ding counter appropriate. This returns the current count (across restart)
+// for the device as seen by this exporter and state, along with the dings that hadn't been seen before.
+func (s *RingStateHandler) UpdateDingCount(bot *ring_types.DoorBot, dings *[]ring_types.DoorBotDing) (uint32, []DingEvent, error) {
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// See if we have state already for this device
+	count := s.findDingCountLocked(bot)
+
+	// Create a new state entry for this device
+	if count == nil {
+		newCount := dingCount{
+			DeviceId: bot.Id,
+		}
+		s.state.DingCounts = append(s.state.DingCounts, newCount)
+		// grab a reference to it
+		count = &s.state.DingCounts[len(s.state.DingCounts)-1]
+	}
+
+	newEvents := countDings(count, bot, dings)
+
+	// History is newest first but the events are kept oldest first
+	sort.SliceStable(newEvents, func(i, j int) bool {
+		return newEvents[i].CreatedAt.Before(newEvents[j].CreatedAt)
+	})
+	s.state.Events = append(s.state.Events, newEvents...)
+	sort.SliceStable(s.state.Events, func(i, j int) bool {
+		return s.state.Events[i].CreatedAt.Before(s.state.Events[j].CreatedAt)
+	})
+	if len(s.state.Events) > maxEvents {
+		s.state.Events = append([]DingEvent(nil), s.state.Events[len(s.state.Events)-maxEvents:]...)
+	}
 
 	// And let the caller know the current count for this device now
-	return count.MyCounter, nil
+	return count.MyCounter, newEvents, nil
 }
@@ -0,0 +1,209 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	FileStateBackend   = "file"
+	BoltStateBackend   = "bolt"
+	MemoryStateBackend = "memory"
+)
+
+// StateBackend persists a `RingState` somewhere.
+type StateBackend interface {
+	// Load returns the persisted state. If nothing has been persisted yet
+	// the error satisfies `os.IsNotExist`.
+	Load() (*RingState, error)
+	// Save persists the state.
+	Save(state *RingState) error
+	// Close releases any resources held by the backend.
+	Close() error
+	// String describes where the state lives, for logging.
+	String() string
+}
+
+// StatePath resolves the location of the state for `cfg`. Relative paths are
+// relative to the directory holding the config file.
+func StatePath(cfgFile string, cfg StateConfig) string {
+	if cfg.Path == "" || filepath.IsAbs(cfg.Path) {
+		return cfg.Path
+	}
+	return filepath.Join(filepath.Dir(cfgFile), cfg.Path)
+}
+
+// OpenStateBackend opens the backend selected by `cfg`.
+func OpenStateBackend(cfgFile string, cfg StateConfig) (StateBackend, error) {
+	switch cfg.Backend {
+	case FileStateBackend:
+		return NewFileStateBackend(StatePath(cfgFile, cfg)), nil
+	case BoltStateBackend:
+		return NewBoltStateBackend(StatePath(cfgFile, cfg))
+	case MemoryStateBackend:
+		return NewMemoryStateBackend(), nil
+	default:
+		return nil, fmt.Errorf("Unknown state backend '%s'", cfg.Backend)
+	}
+}
+
+///////////////////////////////////
+
+type fileStateBackend struct {
+	filename string
+}
+
+// NewFileStateBackend keeps the state in a JSON file. Writes are atomic and
+// the previous generation is kept as a backup to recover from.
+func NewFileStateBackend(filename string) StateBackend {
+	return &fileStateBackend{
+		filename: filename,
+	}
+}
+
+func (b *fileStateBackend) Load() (*RingState, error) {
+	var state *RingState
+	err := readFileWithBackup(b.filename, func(data []byte) error {
+		s := &RingState{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return err
+		}
+		state = s
+		return nil
+	})
+	return state, err
+}
+
+func (b *fileStateBackend) Save(state *RingState) error {
+	data, err := json.MarshalIndent(state, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(b.filename, data, 0600)
+}
+
+func (b *fileStateBackend) Close() error {
+	return nil
+}
+
+func (b *fileStateBackend) String() string {
+	return b.filename
+}
+
+///////////////////////////////////
+
+var (
+	boltBucket   = []byte("ring_exporter")
+	boltStateKey = []byte("state")
+)
+
+type boltStateBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltStateBackend keeps the state in an embedded bbolt database. The
+// database is locked while open so only one process may use it at a time.
+func NewBoltStateBackend(filename string) (StateBackend, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open state database %s", filename)
+	}
+	return &boltStateBackend{
+		db: db,
+	}, nil
+}
+
+func (b *boltStateBackend) Load() (*RingState, error) {
+	state := &RingState{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return os.ErrNotExist
+		}
+		data := bucket.Get(boltStateKey)
+		if data == nil {
+			return os.ErrNotExist
+		}
+		return json.Unmarshal(data, state)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (b *boltStateBackend) Save(state *RingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(boltBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(boltStateKey, data)
+	})
+}
+
+func (b *boltStateBackend) Close() error {
+	return b.db.Close()
+}
+
+func (b *boltStateBackend) String() string {
+	return b.db.Path()
+}
+
+///////////////////////////////////
+
+type memoryStateBackend struct {
+	lock sync.Mutex
+	data []byte
+}
+
+// NewMemoryStateBackend keeps the state in memory only, so nothing survives
+// a restart. It's for tests and trying things out without touching the disk.
+func NewMemoryStateBackend() StateBackend {
+	return &memoryStateBackend{}
+}
+
+func (b *memoryStateBackend) Load() (*RingState, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.data == nil {
+		return nil, os.ErrNotExist
+	}
+	// Round trip through JSON so callers never share memory with us
+	state := &RingState{}
+	if err := json.Unmarshal(b.data, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (b *memoryStateBackend) Save(state *RingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	b.data = data
+	b.lock.Unlock()
+	return nil
+}
+
+func (b *memoryStateBackend) Close() error {
+	return nil
+}
+
+func (b *memoryStateBackend) String() string {
+	return "memory"
+}
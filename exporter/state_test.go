@@ -0,0 +1,161 @@
+package exporter
+
+import (
+	ring_types "github.com/cheezypoofs/ring-exporter/ringapi/types"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testBot = &ring_types.DoorBot{Id: 1, Description: "Front Door"}
+
+// testDings returns dings `from` through `to` (newest first, as the history
+// API does) a minute apart. The ids increase with time like Ring's do.
+func testDings(from int64, to int64) []ring_types.DoorBotDing {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var dings []ring_types.DoorBotDing
+	for id := to; id >= from; id-- {
+		dings = append(dings, ring_types.DoorBotDing{
+			Id:        id,
+			CreatedAt: start.Add(time.Duration(id) * time.Minute).Format(time.RFC3339),
+			Kind:      "ding",
+		})
+	}
+	return dings
+}
+
+func newTestStateHandler(t *testing.T, backend StateBackend, cipher *TokenCipher) *RingStateHandler {
+	t.Helper()
+	handler, err := NewRingStateHandler(backend, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestRingStateHandlerPersistsToken(t *testing.T) {
+	backend := NewMemoryStateBackend()
+
+	handler := newTestStateHandler(t, backend, nil)
+	if token := handler.FetchToken(); token != nil {
+		t.Fatalf("Expected no token in a new state, got %+v", token)
+	}
+	handler.StoreToken(testToken())
+
+	// As if restarted
+	handler = newTestStateHandler(t, backend, nil)
+	token := handler.FetchToken()
+	if token == nil || token.AccessToken != "access" || token.RefreshToken != "refresh" {
+		t.Fatalf("Expected the stored token, got %+v", token)
+	}
+	if handler.TokenUpdatedAt().IsZero() {
+		t.Errorf("Expected the token update time to be kept")
+	}
+
+	if err := handler.ClearToken(); err != nil {
+		t.Fatal(err)
+	}
+	if token = newTestStateHandler(t, backend, nil).FetchToken(); token != nil {
+		t.Errorf("Expected the token to be cleared, got %+v", token)
+	}
+}
+
+func TestRingStateHandlerEncryptsToken(t *testing.T) {
+	backend := NewMemoryStateBackend()
+	cipher, err := NewTokenCipher([]byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestStateHandler(t, backend, cipher).StoreToken(testToken())
+
+	state, err := backend.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Token != nil || !strings.HasPrefix(state.EncryptedToken, tokenCipherVersion) {
+		t.Fatalf("Expected only an encrypted token, got %+v and %q", state.Token, state.EncryptedToken)
+	}
+
+	if _, err = NewRingStateHandler(backend, nil); err == nil {
+		t.Errorf("Expected an encrypted token to need the key")
+	}
+
+	handler := newTestStateHandler(t, backend, cipher)
+	if token := handler.FetchToken(); token == nil || token.AccessToken != "access" {
+		t.Fatalf("Expected the token to be decrypted, got %+v", token)
+	}
+
+	// Back to plaintext
+	if err = handler.Rekey(nil); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = backend.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if state.EncryptedToken != "" || state.Token == nil || state.Token.AccessToken != "access" {
+		t.Errorf("Expected only a plaintext token, got %+v and %q", state.Token, state.EncryptedToken)
+	}
+}
+
+func TestUpdateDingCountAcrossRestart(t *testing.T) {
+	backend := NewMemoryStateBackend()
+
+	handler := newTestStateHandler(t, backend, nil)
+	dings := testDings(1, 3)
+	count, events, err := handler.UpdateDingCount(testBot, &dings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 || len(events) != 3 {
+		t.Fatalf("Expected 3 new dings, got a count of %d and %d events", count, len(events))
+	}
+	if err = handler.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart only the dings after the bookmark are counted, and
+	// that's persisted too. The oldest has aged off the page of history.
+	handler = newTestStateHandler(t, backend, nil)
+	dings = testDings(2, 5)
+	if count, events, _ = handler.UpdateDingCount(testBot, &dings); count != 5 || len(events) != 2 {
+		t.Fatalf("Expected 2 new dings, got a count of %d and %d events", count, len(events))
+	}
+	if count, events, _ = handler.UpdateDingCount(testBot, &dings); count != 5 || len(events) != 0 {
+		t.Fatalf("Expected no new dings, got a count of %d and %d events", count, len(events))
+	}
+	if err = handler.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler = newTestStateHandler(t, backend, nil)
+	if count, events, _ = handler.UpdateDingCount(testBot, &dings); count != 5 || len(events) != 0 {
+		t.Fatalf("Expected no new dings, got a count of %d and %d events", count, len(events))
+	}
+
+	// Newest first and each only once
+	kept := handler.Events(time.Time{})
+	if len(kept) != 5 || kept[0].Id != 5 || kept[4].Id != 1 {
+		t.Errorf("Expected dings 5 to 1, got %+v", kept)
+	}
+}
+
+func TestDingCountLeavesStateAlone(t *testing.T) {
+	handler := newTestStateHandler(t, NewMemoryStateBackend(), nil)
+
+	dings := testDings(1, 2)
+	handler.UpdateDingCount(testBot, &dings)
+
+	dings = testDings(1, 4)
+	if count := handler.DingCount(testBot, &dings); count != 4 {
+		t.Errorf("Expected a count of 4, got %d", count)
+	}
+	if count := handler.DingCount(testBot, &dings); count != 4 {
+		t.Errorf("Expected a count of 4 again, got %d", count)
+	}
+
+	// The dings counted by DingCount are still new to UpdateDingCount
+	if count, events, _ := handler.UpdateDingCount(testBot, &dings); count != 4 || len(events) != 2 {
+		t.Errorf("Expected 2 new dings, got a count of %d and %d events", count, len(events))
+	}
+}
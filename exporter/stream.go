@@ -0,0 +1,349 @@
+package exporter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventStreamRoute = "/events/stream"
+
+	// StreamEvent types
+	DingStreamEvent       = "ding"
+	BatteryLowStreamEvent = "battery_low"
+	BatteryOkStreamEvent  = "battery_ok"
+	FirmwareStreamEvent   = "firmware_changed"
+	// ResetStreamEvent tells a reconnecting subscriber that what it missed
+	// can't all be replayed. It should refetch the devices and events.
+	ResetStreamEvent = "reset"
+
+	// how many events other than dings are kept to replay to reconnecting
+	// subscribers. Dings are replayed from the state.
+	streamReplaySize = 256
+	// how many events a subscriber may fall behind before it's dropped
+	streamSubscriberBuffer = 64
+	// comments are sent this often to keep proxies from timing out idle streams
+	streamKeepAlive = 30 * time.Second
+)
+
+// StreamEvent is pushed to subscribers of the event stream when a poll
+// notices something new.
+type StreamEvent struct {
+	// Id is the SSE id of the event as sent to a particular subscriber.
+	Id          string    `json:"id"`
+	Type        string    `json:"type"`
+	Account     string    `json:"account"`
+	DeviceId    uint32    `json:"device_id"`
+	Description string    `json:"description"`
+	Time        time.Time `json:"time"`
+	// Ding is set for `ding` events. Its kind tells dings from motion, etc.
+	Ding *DingEvent `json:"ding,omitempty"`
+	// BatteryPercent is set for `battery_low` and `battery_ok` events.
+	BatteryPercent *float64 `json:"battery_percent,omitempty"`
+	// Firmware and PreviousFirmware are set for `firmware_changed` events.
+	Firmware         string `json:"firmware,omitempty"`
+	PreviousFirmware string `json:"previous_firmware,omitempty"`
+	// Reason is set for `reset` events.
+	Reason string `json:"reason,omitempty"`
+
+	// seq orders the events other than dings
+	seq uint64
+}
+
+// streamCursor is the SSE id of an event, `<ding>-<seq>`. It says how far a
+// subscriber got: the newest ding sent, by Ring's ding id, and the newest
+// other event sent, by the sequence the broker gives those.
+type streamCursor struct {
+	ding int64
+	seq  uint64
+}
+
+func (c streamCursor) String() string {
+	return fmt.Sprintf("%d-%d", c.ding, c.seq)
+}
+
+func parseStreamCursor(value string) (streamCursor, error) {
+	var c streamCursor
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return c, fmt.Errorf("'%s' is not an event id", value)
+	}
+	var err error
+	if c.ding, err = strconv.ParseInt(parts[0], 10, 64); err != nil {
+		return c, fmt.Errorf("'%s' is not an event id", value)
+	}
+	if c.seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+		return c, fmt.Errorf("'%s' is not an event id", value)
+	}
+	return c, nil
+}
+
+// advance moves the cursor past `event`.
+func (c *streamCursor) advance(event *StreamEvent) {
+	if event.Ding != nil && event.Ding.Id > c.ding {
+		c.ding = event.Ding.Id
+	}
+	if event.seq > c.seq {
+		c.seq = event.seq
+	}
+}
+
+// eventBroker fans events out to subscribers and keeps the most recent ones
+// other than dings so that a subscriber reconnecting with the id of the last
+// event it saw can be sent what it missed.
+type eventBroker struct {
+	lock        sync.Mutex
+	lastDing    int64
+	firstSeq    uint64
+	nextSeq     uint64
+	recent      []StreamEvent
+	subscribers map[chan StreamEvent]bool
+	closed      bool
+}
+
+// newEventBroker creates an eventBroker which has already published up to
+// the ding `lastDing`.
+func newEventBroker(lastDing int64) *eventBroker {
+	// Sequences keep increasing across restarts so that a subscriber from
+	// before a restart is known to have missed whatever happened since.
+	seq := uint64(time.Now().UnixNano())
+	return &eventBroker{
+		lastDing:    lastDing,
+		firstSeq:    seq,
+		nextSeq:     seq,
+		subscribers: map[chan StreamEvent]bool{},
+	}
+}
+
+// publish sends the event to the subscribers. A subscriber too far behind is
+// dropped; it can reconnect and catch up.
+func (b *eventBroker) publish(event StreamEvent) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if event.Ding != nil {
+		if event.Ding.Id > b.lastDing {
+			b.lastDing = event.Ding.Id
+		}
+	} else {
+		event.seq = b.nextSeq
+		b.nextSeq++
+
+		b.recent = append(b.recent, event)
+		if len(b.recent) > streamReplaySize {
+			b.recent = append([]StreamEvent(nil), b.recent[len(b.recent)-streamReplaySize:]...)
+		}
+	}
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe returns the events other than dings after sequence `after`,
+// whether those are all of them, the cursor of everything published so far
+// and a channel of the events to come. The channel is closed when the
+// subscriber is dropped or the broker closed. `cancel` must be called when done.
+func (b *eventBroker) subscribe(after uint64) (replay []StreamEvent, complete bool, latest streamCursor, events <-chan StreamEvent, cancel func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	latest = streamCursor{ding: b.lastDing, seq: b.nextSeq - 1}
+	for _, event := range b.recent {
+		if event.seq > after {
+			replay = append(replay, event)
+		}
+	}
+	switch {
+	case after < b.firstSeq-1 || after > latest.seq:
+		// From before a restart (or a clock that went back)
+		complete = false
+	case len(b.recent) > 0:
+		complete = b.recent[0].seq <= after+1
+	default:
+		complete = true
+	}
+
+	subscriber := make(chan StreamEvent, streamSubscriberBuffer)
+	if b.closed {
+		close(subscriber)
+		return replay, complete, latest, subscriber, func() {}
+	}
+	b.subscribers[subscriber] = true
+
+	cancel = func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if b.subscribers[subscriber] {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return replay, complete, latest, subscriber, cancel
+}
+
+// close ends every subscription, such as when shutting down.
+func (b *eventBroker) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.closed = true
+	for subscriber := range b.subscribers {
+		delete(b.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// CloseStreams ends the event streams so that the web server can shut down
+// without waiting on them.
+func (m *Monitor) CloseStreams() {
+	m.stream.close()
+}
+
+func writeStreamEvent(w http.ResponseWriter, event StreamEvent, cursor streamCursor) error {
+	event.Id = cursor.String()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data)
+	return err
+}
+
+// dingStreamEvent converts a ding counted for `account`.
+func dingStreamEvent(account *Account, ding DingEvent) StreamEvent {
+	return StreamEvent{
+		Type:        DingStreamEvent,
+		Account:     account.Name,
+		DeviceId:    ding.DeviceId,
+		Description: ding.Description,
+		Time:        ding.CreatedAt,
+		Ding:        &ding,
+	}
+}
+
+// dingsAfter returns the dings kept in the state of every account with an id
+// greater than `id`, and whether those are all of them.
+func (m *Monitor) dingsAfter(id int64) ([]StreamEvent, bool) {
+	var events []StreamEvent
+	complete := true
+	for _, account := range m.Accounts {
+		dings, ok := account.StateHandler.EventsAfter(id)
+		complete = complete && ok
+		for _, ding := range dings {
+			events = append(events, dingStreamEvent(account, ding))
+		}
+	}
+	return events, complete
+}
+
+// handleEventStream serves the events as Server-Sent Events. Subscribers
+// reconnecting with Last-Event-ID are sent whatever they missed first: the
+// dings from the state and the other events from memory. If some of that is
+// gone (such as the other events after a restart), they're sent a `reset`
+// event instead and carry on from there.
+func (m *Monitor) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	var cursor streamCursor
+	var resetReason string
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId != "" {
+		var err error
+		if cursor, err = parseStreamCursor(lastEventId); err != nil {
+			resetReason = fmt.Sprintf("Last-Event-ID %v", err)
+		}
+	}
+
+	others, complete, latest, events, cancel := m.stream.subscribe(cursor.seq)
+	defer cancel()
+
+	var replay []StreamEvent
+	if lastEventId != "" && resetReason == "" {
+		dings, dingsComplete := m.dingsAfter(cursor.ding)
+		if !complete || !dingsComplete {
+			resetReason = "Some of the events since Last-Event-ID are no longer kept"
+		} else {
+			replay = append(dings, others...)
+			sort.SliceStable(replay, func(i, j int) bool {
+				return replay[i].Time.Before(replay[j].Time)
+			})
+		}
+	}
+	if lastEventId == "" || resetReason != "" {
+		// Carry on from now
+		cursor = latest
+	}
+	if resetReason != "" {
+		// The subscriber is to refetch the events, so they're not to be replayed next time
+		for _, account := range m.Accounts {
+			if id := account.StateHandler.LatestEventId(); id > cursor.ding {
+				cursor.ding = id
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx and the like from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if resetReason != "" {
+		reset := StreamEvent{Type: ResetStreamEvent, Time: time.Now(), Reason: resetReason}
+		if err := writeStreamEvent(w, reset, cursor); err != nil {
+			return
+		}
+	}
+	for i := range replay {
+		cursor.advance(&replay[i])
+		if err := writeStreamEvent(w, replay[i], cursor); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if event.Ding != nil && event.Ding.Id <= cursor.ding {
+				// Already replayed from the state
+				continue
+			}
+			cursor.advance(&event)
+			if err := writeStreamEvent(w, event, cursor); err != nil {
+				log.Printf("Failed to send event to %s: %v", r.RemoteAddr, err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,231 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreamCursor(t *testing.T) {
+	tests := []struct {
+		value  string
+		cursor streamCursor
+		fails  bool
+	}{
+		{value: "12-34", cursor: streamCursor{ding: 12, seq: 34}},
+		{value: "0-0", cursor: streamCursor{}},
+		{value: "", fails: true},
+		{value: "12", fails: true},
+		{value: "12-", fails: true},
+		{value: "-12-34", fails: true},
+		{value: "12-34-56", fails: true},
+		{value: "12--34", fails: true},
+		{value: "ding-34", fails: true},
+	}
+
+	for _, test := range tests {
+		cursor, err := parseStreamCursor(test.value)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %+v", test.value, cursor)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.value, err)
+		} else if cursor != test.cursor {
+			t.Errorf("%q: expected %+v, got %+v", test.value, test.cursor, cursor)
+		}
+		if cursor.String() != test.value {
+			t.Errorf("%q: formatted as %q", test.value, cursor.String())
+		}
+	}
+}
+
+func TestEventsAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		dings    int64
+		after    int64
+		first    int64
+		count    int
+		complete bool
+	}{
+		{name: "all", dings: 5, after: 0, first: 1, count: 5, complete: true},
+		{name: "some", dings: 5, after: 3, first: 4, count: 2, complete: true},
+		{name: "none", dings: 5, after: 5, count: 0, complete: true},
+		{name: "full state", dings: maxEvents + 100, after: 500, first: 501, count: maxEvents - 400, complete: true},
+		{name: "older than kept", dings: maxEvents + 100, after: 50, first: 101, count: maxEvents, complete: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := newTestStateHandler(t, NewMemoryStateBackend(), nil)
+			dings := testDings(1, test.dings)
+			handler.UpdateDingCount(testBot, &dings)
+
+			events, complete := handler.EventsAfter(test.after)
+			if len(events) != test.count || complete != test.complete {
+				t.Fatalf("Expected %d events and complete %v, got %d and %v", test.count, test.complete, len(events), complete)
+			}
+			if test.count > 0 && events[0].Id != test.first {
+				t.Errorf("Expected the first event to be %d, got %d", test.first, events[0].Id)
+			}
+		})
+	}
+}
+
+// streamedEvent is an event as sent on the wire.
+type streamedEvent struct {
+	id  string
+	typ string
+}
+
+// streamEvents serves the event stream to a subscriber with `lastEventId`
+// and returns what it's sent. The broker must be closed so that it returns.
+func streamEvents(t *testing.T, m *Monitor, lastEventId string) []streamedEvent {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, eventStreamRoute, nil)
+	if lastEventId != "" {
+		r.Header.Set("Last-Event-ID", lastEventId)
+	}
+	w := httptest.NewRecorder()
+	m.handleEventStream(w, r)
+
+	var events []streamedEvent
+	for _, message := range strings.Split(w.Body.String(), "\n\n") {
+		var event streamedEvent
+		for _, line := range strings.Split(message, "\n") {
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				event.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				event.typ = strings.TrimPrefix(line, "event: ")
+			}
+		}
+		if event.typ != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func TestEventStreamReplay(t *testing.T) {
+	// The state has dings 1 to 5, or so many that the oldest were dropped
+	newMonitor := func(t *testing.T, dingCount int64) *Monitor {
+		handler := newTestStateHandler(t, NewMemoryStateBackend(), nil)
+		dings := testDings(1, dingCount)
+		handler.UpdateDingCount(testBot, &dings)
+
+		m := &Monitor{
+			Accounts: []*Account{{Name: "default", StateHandler: handler}},
+			stream:   newEventBroker(handler.LatestEventId()),
+		}
+		// After the dings, so that it's replayed after them
+		battery := 10.0
+		m.stream.publish(StreamEvent{
+			Type:           BatteryLowStreamEvent,
+			Account:        "default",
+			Time:           time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+			BatteryPercent: &battery,
+		})
+		m.stream.close()
+		return m
+	}
+
+	// The sequence of the battery event, and the one before
+	seq := func(m *Monitor) (uint64, uint64) {
+		return m.stream.nextSeq - 1, m.stream.nextSeq - 2
+	}
+
+	tests := []struct {
+		name        string
+		dingCount   int64
+		lastEventId func(m *Monitor) string
+		expected    func(m *Monitor) []streamedEvent
+	}{
+		{
+			name:        "empty cursor",
+			dingCount:   5,
+			lastEventId: func(m *Monitor) string { return "" },
+			expected:    func(m *Monitor) []streamedEvent { return nil },
+		},
+		{
+			name:      "valid cursor",
+			dingCount: 5,
+			lastEventId: func(m *Monitor) string {
+				_, before := seq(m)
+				return fmt.Sprintf("3-%d", before)
+			},
+			expected: func(m *Monitor) []streamedEvent {
+				battery, before := seq(m)
+				return []streamedEvent{
+					{id: fmt.Sprintf("4-%d", before), typ: DingStreamEvent},
+					{id: fmt.Sprintf("5-%d", before), typ: DingStreamEvent},
+					{id: fmt.Sprintf("5-%d", battery), typ: BatteryLowStreamEvent},
+				}
+			},
+		},
+		{
+			name:      "up to date cursor",
+			dingCount: 5,
+			lastEventId: func(m *Monitor) string {
+				battery, _ := seq(m)
+				return fmt.Sprintf("5-%d", battery)
+			},
+			expected: func(m *Monitor) []streamedEvent { return nil },
+		},
+		{
+			name:      "cursor older than the kept dings",
+			dingCount: maxEvents + 100,
+			lastEventId: func(m *Monitor) string {
+				_, before := seq(m)
+				return fmt.Sprintf("50-%d", before)
+			},
+			expected: func(m *Monitor) []streamedEvent {
+				battery, _ := seq(m)
+				return []streamedEvent{{id: fmt.Sprintf("%d-%d", maxEvents+100, battery), typ: ResetStreamEvent}}
+			},
+		},
+		{
+			name:        "cursor from before a restart",
+			dingCount:   5,
+			lastEventId: func(m *Monitor) string { return "3-1" },
+			expected: func(m *Monitor) []streamedEvent {
+				battery, _ := seq(m)
+				return []streamedEvent{{id: fmt.Sprintf("5-%d", battery), typ: ResetStreamEvent}}
+			},
+		},
+		{
+			name:        "garbage cursor",
+			dingCount:   5,
+			lastEventId: func(m *Monitor) string { return "garbage" },
+			expected: func(m *Monitor) []streamedEvent {
+				battery, _ := seq(m)
+				return []streamedEvent{{id: fmt.Sprintf("5-%d", battery), typ: ResetStreamEvent}}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newMonitor(t, test.dingCount)
+			events := streamEvents(t, m, test.lastEventId(m))
+			expected := test.expected(m)
+
+			if len(events) != len(expected) {
+				t.Fatalf("Expected %v, got %v", expected, events)
+			}
+			for i := range expected {
+				if events[i] != expected[i] {
+					t.Errorf("Expected %v, got %v", expected, events)
+					break
+				}
+			}
+		})
+	}
+}
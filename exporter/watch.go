@@ -0,0 +1,53 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+)
+
+// WatchConfigFile polls `filename` every `interval` and signals the returned
+// channel whenever its content changes. Polling the content (rather than
+// relying on inotify or mtimes) copes with editors that replace the file and
+// with Kubernetes ConfigMaps that swap symlinks. Watching stops when `quit`
+// is closed.
+func WatchConfigFile(filename string, interval time.Duration, quit <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	hash := func() []byte {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := hash()
+		for {
+			select {
+			case <-ticker.C:
+				current := hash()
+				if bytes.Equal(current, last) {
+					continue
+				}
+				last = current
+
+				// Don't block if a reload is already pending
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	return changed
+}
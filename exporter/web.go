@@ -0,0 +1,191 @@
+package exporter
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	unixAddressPrefix = "unix:"
+
+	probeRoute   = "/probe"
+	healthzRoute = "/healthz"
+	readyzRoute  = "/readyz"
+)
+
+// reservedRoutes can't be used for the metrics.
+var reservedRoutes = []string{probeRoute, healthzRoute, readyzRoute, apiDevicesRoute, apiEventsRoute, apiStatusRoute, eventStreamRoute}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Ring Exporter</title></head>
+<body>
+<h1>Ring Exporter</h1>
+<ul>
+<li><a href="{{.MetricsRoute}}">Metrics</a></li>
+<li><a href="` + healthzRoute + `">Health</a></li>
+<li><a href="` + readyzRoute + `">Readiness</a></li>
+<li><a href="` + apiDevicesRoute + `">Devices</a> (JSON)</li>
+<li><a href="` + apiEventsRoute + `">Events</a> (JSON)</li>
+<li><a href="` + apiStatusRoute + `">Status</a> (JSON)</li>
+<li><a href="` + eventStreamRoute + `">Event stream</a> (Server-Sent Events)</li>
+</ul>
+<p>Probe a single device with <code>` + probeRoute + `?device=&lt;name or id&gt;&amp;account=&lt;name&gt;</code>.</p>
+</body>
+</html>
+`))
+
+func validateListenAddress(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if strings.HasPrefix(addr, unixAddressPrefix) {
+		if strings.TrimPrefix(addr, unixAddressPrefix) == "" {
+			return fmt.Errorf("'%s' is missing the socket path", addr)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("'%s' must be host:port or unix:/path/to/socket", addr)
+	}
+	return nil
+}
+
+func validateMetricsRoute(route string) error {
+	for _, reserved := range reservedRoutes {
+		if route == reserved {
+			return fmt.Errorf("'%s' is reserved", route)
+		}
+	}
+	return nil
+}
+
+// Listen binds the address configured by `cfg`. Relative socket paths are
+// relative to the directory holding the config file.
+func Listen(cfgFile string, cfg WebConfig) (net.Listener, error) {
+	network, address := "tcp", cfg.ListenAddress
+	if address == "" {
+		address = fmt.Sprintf(":%d", cfg.Port)
+	}
+
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		network = "unix"
+		address = StatePath(cfgFile, StateConfig{Path: strings.TrimPrefix(address, unixAddressPrefix)})
+
+		// A socket left behind by a crash would fail the bind. One which
+		// somebody is still listening on is left alone.
+		if info, err := os.Stat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout(network, address, time.Second); err == nil {
+				conn.Close()
+			} else {
+				os.Remove(address)
+			}
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to listen on %s", address)
+	}
+	return listener, nil
+}
+
+// WebConfigFile returns the path of the TLS and basic auth config, if any.
+// Relative paths are relative to the directory holding the config file.
+func WebConfigFile(cfgFile string, cfg WebConfig) string {
+	if cfg.ConfigFile == "" {
+		return ""
+	}
+	return StatePath(cfgFile, StateConfig{Path: cfg.ConfigFile})
+}
+
+// ValidateWebConfigFile checks the TLS and basic auth config along with the
+// certificates it names.
+func ValidateWebConfigFile(cfgFile string, cfg WebConfig) error {
+	if err := web.Validate(WebConfigFile(cfgFile, cfg)); err != nil {
+		return errors.Wrapf(err, "Invalid web_config.config_file")
+	}
+	return nil
+}
+
+// Serve serves `server` on `listener` with the TLS and basic auth configured
+// by web_config.config_file. The file is read again for each new connection
+// so that renewed certificates and changed users are picked up without a
+// restart.
+func Serve(listener net.Listener, server *http.Server, cfgFile string, cfg WebConfig) error {
+	return web.Serve(listener, server, WebConfigFile(cfgFile, cfg), webLogger{})
+}
+
+// Handler routes the metrics, probes, health checks and a landing page.
+func (m *Monitor) Handler(metrics prometheus.Gatherer) http.Handler {
+	route := m.Config.WebConfig.MetricsRoute
+
+	mux := http.NewServeMux()
+	mux.Handle(route, promhttp.HandlerFor(metrics, promhttp.HandlerOpts{}))
+	mux.Handle(probeRoute, m.ProbeHandler())
+	mux.HandleFunc(healthzRoute, handleHealthz)
+	mux.HandleFunc(readyzRoute, m.handleReadyz)
+	mux.HandleFunc(apiDevicesRoute, m.handleApiDevices)
+	mux.HandleFunc(apiEventsRoute, m.handleApiEvents)
+	mux.HandleFunc(apiStatusRoute, m.handleApiStatus)
+	mux.HandleFunc(eventStreamRoute, m.handleEventStream)
+	if route != "/" {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			handleLanding(w, r, route)
+		})
+	}
+	return mux
+}
+
+func handleLanding(w http.ResponseWriter, r *http.Request, metricsRoute string) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	data := struct {
+		MetricsRoute string
+	}{metricsRoute}
+	if err := landingTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render the landing page: %v", err)
+	}
+}
+
+// handleHealthz reports that the process is up, whatever state Ring is in.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "OK")
+}
+
+// handleReadyz reports whether every account has been polled and has a
+// valid token.
+func (m *Monitor) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := m.Ready(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+// webLogger adapts the standard logger to the key/value logger the
+// exporter-toolkit wants.
+type webLogger struct{}
+
+func (webLogger) Log(keyvals ...interface{}) error {
+	pairs := make([]string, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", keyvals[i], keyvals[i+1]))
+	}
+	log.Print(strings.Join(pairs, " "))
+	return nil
+}
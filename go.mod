@@ -3,11 +3,14 @@ module github.com/cheezypoofs/ring-exporter
 go 1.15
 
 require (
-	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
+	github.com/BurntSushi/toml v0.3.1
 	github.com/google/uuid v1.1.2
 	github.com/pkg/errors v0.9.1
 	github.com/prometheus/client_golang v1.7.1
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	github.com/prometheus/exporter-toolkit v0.5.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20201208171446-5f87f3452ae9
 	golang.org/x/oauth2 v0.0.0-20200902213428-5d25da1a8d43
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -3,9 +3,9 @@ package ringapi
 import (
 	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 	"log"
-	"net/http"
 )
 
 var (
@@ -32,20 +32,15 @@ type TokenHandler interface {
 // application.
 type Authenticator interface {
 	PromptCredentials() (string, string, error)
-	Prompt2FACode() (string, error)
+	// Prompt2FACode returns the code for `challenge`, or ErrResend2FACode
+	// to have it sent again. It should give up waiting once `ctx` is done.
+	Prompt2FACode(ctx context.Context, challenge *LoginChallenge) (string, error)
 }
 
-type interceptRoundTripper struct {
-	code string
-}
-
-func (i *interceptRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Intercept the Token request to inject the 2FA code into the header.
-	// This is how ring API does 2FA.
-	req.Header.Add("2fa-support", "true")
-	req.Header.Add("2fa-code", i.code)
-	return http.DefaultTransport.RoundTrip(req)
-}
+// ErrResend2FACode may be returned by `Authenticator.Prompt2FACode` to request
+// that the code be sent again (which only makes sense for SMS). The
+// Authenticator is then prompted again.
+var ErrResend2FACode = errors.New("Resend the 2FA code")
 
 // OpenAuthorizedSession creates a new AuthorizedSession instance by
 // retreiving an OAUTH2 Token. This token might already exist, in which case
@@ -66,59 +61,83 @@ func OpenAuthorizedSession(cfg ApiConfig, t TokenHandler, a Authenticator) (*Aut
 
 		log.Printf("No previously stored token found. Will need to authorize")
 
-		u, p, err := a.PromptCredentials()
-		if err != nil {
+		var err error
+		if token, err = AuthorizeToken(context.Background(), a); err != nil {
 			return nil, err
 		}
 
-		// Attempt to get an OAUTH token by password. This will typically fail
-		// but send a prompt to the user's phone or whatever with a code to enter.
-		token, err = oauthConfig.PasswordCredentialsToken(oauth2.NoContext, u, p)
-		if err == nil {
-			log.Printf("Password-only auth worked")
-		} else {
-			rErr, ok := err.(*oauth2.RetrieveError)
-			if !ok {
-				return nil, err
-			}
+		t.StoreToken(token)
+	}
 
-			// 412 (Precondition Failed) is how ring indicates 2FA is in play
-			if rErr.Response.StatusCode != 412 {
-				return nil, err
-			}
+	log.Printf("Token acquired")
 
-			log.Printf("Ring indicates 2FA code needed")
+	session := &AuthorizedSession{
+		client: oauth2.NewClient(oauth2.NoContext, newStoringTokenSource(token, t)),
+		config: cfg,
+	}
 
-			// Prompt for that code and then we'll do it again.
-			code, err := a.Prompt2FACode()
-			if err != nil {
-				return nil, fmt.Errorf("Failure prompting for 2FA: %v", err)
-			}
+	return session, nil
+}
+
+// AuthorizeToken authorizes a new token with the credentials and 2FA code
+// from `a`. Nothing is stored, so a token already stored stays in use until
+// the caller replaces it. Cancelling `ctx` gives up, even while waiting on the
+// 2FA code.
+func AuthorizeToken(ctx context.Context, a Authenticator) (*oauth2.Token, error) {
+	if a == nil {
+		return nil, fmt.Errorf("Authenticator is required")
+	}
+
+	u, p, err := a.PromptCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	// Attempt to get an OAUTH token by password. This will typically
+	// result in a challenge and send a code to the user's phone or whatever.
+	token, challenge, err := LoginStart(ctx, u, p)
+	if err != nil {
+		return nil, err
+	}
+
+	if challenge == nil {
+		log.Printf("Password-only auth worked")
+		return token, nil
+	}
+
+	log.Printf("Ring indicates 2FA code needed (%s)", challenge.Method)
 
-			client := &http.Client{
-				Transport: &interceptRoundTripper{
-					code: code,
-				},
+	// We get the token via 2FA
+	return complete2FA(ctx, challenge, a)
+}
+
+// complete2FA prompts for the code (sending it again as often as asked to)
+// and then exchanges it for the token.
+func complete2FA(ctx context.Context, challenge *LoginChallenge, a Authenticator) (*oauth2.Token, error) {
+	for {
+		code, err := a.Prompt2FACode(ctx, challenge)
+		if err == ErrResend2FACode {
+			if challenge.Method != SMSChallenge {
+				log.Printf("A %s code can't be resent", challenge.Method)
+				continue
 			}
-			ctx := context.WithValue(oauth2.NoContext, oauth2.HTTPClient, client)
 
-			token, err = oauthConfig.PasswordCredentialsToken(ctx, u, p)
+			log.Printf("Resending the 2FA code")
+			token, next, err := LoginResend(ctx, challenge)
 			if err != nil {
 				return nil, err
 			}
-
-			// We got the token via 2FA
+			if token != nil {
+				// Ring changed its mind about needing a code
+				return token, nil
+			}
+			challenge = next
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failure prompting for 2FA: %v", err)
 		}
 
-		t.StoreToken(token)
-	}
-
-	log.Printf("Token acquired")
-
-	session := &AuthorizedSession{
-		client: oauthConfig.Client(oauth2.NoContext, token),
-		config: cfg,
+		return LoginComplete(ctx, challenge, code)
 	}
-
-	return session, nil
 }
@@ -7,7 +7,7 @@ import (
 // ApiConfig provides a way to alter API behaviors. This is a serializable
 // structure.
 type ApiConfig struct {
-	HardwareId string `json:"hardware_id"`
+	HardwareId string `json:"hardware_id" yaml:"hardware_id" toml:"hardware_id"`
 }
 
 // EnsureApiConfigDefaults handles setting sane defaults
@@ -18,8 +18,13 @@ func EnsureApiConfigDefaults(config *ApiConfig) bool {
 
 	if config.HardwareId == "" {
 		dirty = true
-		hardwareId, _ := uuid.NewRandom()
-		config.HardwareId = hardwareId.String()
+		config.HardwareId = NewHardwareId()
 	}
 	return dirty
 }
+
+// NewHardwareId generates a new random hardware id to identify this client to the API.
+func NewHardwareId() string {
+	hardwareId, _ := uuid.NewRandom()
+	return hardwareId.String()
+}
@@ -11,4 +11,6 @@ const (
 	urlDingsActive = "/clients_api/dings/active"
 	uriHealth      = "/health"
 	uriHistory     = "/history"
+
+	historyPageSize = 50
 )
@@ -0,0 +1,41 @@
+package ringapi
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strings"
+)
+
+// APIError is returned when the API responds with a failure status.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API request failed %v %v", e.Status, e.Body)
+}
+
+// IsUnauthorized returns true if `err` indicates the token is no longer any
+// good, either because the API rejected it or because refreshing it was
+// refused (such as when the refresh token has been revoked). Retrying won't
+// help; the token needs to be authorized again.
+func IsUnauthorized(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusUnauthorized
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusUnauthorized {
+			return true
+		}
+		return strings.Contains(string(retrieveErr.Body), "invalid_grant")
+	}
+
+	return false
+}
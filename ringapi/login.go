@@ -0,0 +1,124 @@
+package ringapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/oauth2"
+	"net/http"
+)
+
+const (
+	// SMSChallenge means the 2FA code was sent to a phone by SMS.
+	SMSChallenge = "sms"
+	// TOTPChallenge means the 2FA code comes from an authenticator app.
+	TOTPChallenge = "totp"
+)
+
+// LoginChallenge is a login which is waiting on a 2FA code. Retrieve it with
+// LoginStart and hand it to LoginComplete once the code is known, which may be
+// much later (in another HTTP request, say). It holds the credentials, so keep
+// it no longer than needed.
+type LoginChallenge struct {
+	// Method is SMSChallenge or TOTPChallenge. Anything else Ring comes up with
+	// is passed along as-is.
+	Method string
+	// Phone is the masked phone number the code was sent to, if any.
+	Phone string
+
+	username string
+	password string
+}
+
+// Prompt describes where the user should look for the code.
+func (c *LoginChallenge) Prompt() string {
+	switch {
+	case c.Method == TOTPChallenge:
+		return "Enter your TOTP code"
+	case c.Phone != "":
+		return fmt.Sprintf("Enter the code sent to %s", c.Phone)
+	default:
+		return "Enter the 2FA code"
+	}
+}
+
+// twoFactorResponse is the body of the 412 response
+type twoFactorResponse struct {
+	TsvState string `json:"tsv_state"`
+	Phone    string `json:"phone"`
+}
+
+type interceptRoundTripper struct {
+	code string
+}
+
+func (i *interceptRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Intercept the Token request to inject the 2FA code into the header.
+	// This is how ring API does 2FA.
+	req.Header.Add("2fa-support", "true")
+	req.Header.Add("2fa-code", i.code)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func passwordToken(ctx context.Context, username string, password string, code string) (*oauth2.Token, error) {
+	client := &http.Client{
+		Transport: &interceptRoundTripper{
+			code: code,
+		},
+	}
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, client)
+	return oauthConfig.PasswordCredentialsToken(ctx, username, password)
+}
+
+// LoginStart attempts to get a token with just the username and password. If
+// Ring wants a 2FA code instead (and has sent it, when by SMS), the token is nil
+// and the returned challenge must be completed with LoginComplete. Cancelling
+// `ctx` aborts the request.
+func LoginStart(ctx context.Context, username string, password string) (*oauth2.Token, *LoginChallenge, error) {
+	token, err := passwordToken(ctx, username, password, "")
+	if err == nil {
+		return token, nil, nil
+	}
+
+	rErr, ok := err.(*oauth2.RetrieveError)
+	// 412 (Precondition Failed) is how ring indicates 2FA is in play
+	if !ok || rErr.Response == nil || rErr.Response.StatusCode != http.StatusPreconditionFailed {
+		return nil, nil, err
+	}
+
+	challenge := &LoginChallenge{
+		Method:   SMSChallenge,
+		username: username,
+		password: password,
+	}
+
+	// Older responses have no body, in which case it was an SMS
+	var details twoFactorResponse
+	if json.Unmarshal(rErr.Body, &details) == nil {
+		if details.TsvState != "" {
+			challenge.Method = details.TsvState
+		}
+		challenge.Phone = details.Phone
+	}
+
+	return nil, challenge, nil
+}
+
+// LoginResend asks for the SMS code of a pending challenge to be sent again.
+// It returns a new challenge to be completed in place of the old one. As with
+// LoginStart, a token is returned instead if Ring no longer wants a code.
+func LoginResend(ctx context.Context, challenge *LoginChallenge) (*oauth2.Token, *LoginChallenge, error) {
+	if challenge == nil {
+		return nil, nil, fmt.Errorf("LoginChallenge is required")
+	}
+	// Asking without a code is what sends one
+	return LoginStart(ctx, challenge.username, challenge.password)
+}
+
+// LoginComplete exchanges the challenge and its 2FA code for a token.
+func LoginComplete(ctx context.Context, challenge *LoginChallenge, code string) (*oauth2.Token, error) {
+	if challenge == nil {
+		return nil, fmt.Errorf("LoginChallenge is required")
+	}
+	return passwordToken(ctx, challenge.username, challenge.password, code)
+}
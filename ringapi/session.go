@@ -2,6 +2,7 @@ package ringapi
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	ring_types "github.com/cheezypoofs/ring-exporter/ringapi/types"
@@ -9,7 +10,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 ///////////////////////////////////
@@ -19,10 +22,27 @@ import (
 type AuthorizedSession struct {
 	client *http.Client
 	config ApiConfig
+	ctx    context.Context
 }
 
-func query(client *http.Client, method string, uri string, inParam io.Reader, outParam interface{}) error {
-	request, err := http.NewRequest(method, baseUrl+uri, inParam)
+// WithContext returns a copy of the session whose API calls are bound to `ctx`.
+// Cancelling `ctx` aborts any calls in flight.
+func (session *AuthorizedSession) WithContext(ctx context.Context) *AuthorizedSession {
+	bound := *session
+	bound.ctx = ctx
+	return &bound
+}
+
+func (session *AuthorizedSession) query(method string, uri string, inParam io.Reader, outParam interface{}) error {
+	ctx := session.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return query(ctx, session.client, method, uri, inParam, outParam)
+}
+
+func query(ctx context.Context, client *http.Client, method string, uri string, inParam io.Reader, outParam interface{}) error {
+	request, err := http.NewRequestWithContext(ctx, method, baseUrl+uri, inParam)
 	if err != nil {
 		return err
 	}
@@ -48,7 +68,16 @@ func query(client *http.Client, method string, uri string, inParam io.Reader, ou
 	// fmt.Println(body)
 
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("API request failed %v %v", resp.Status, body)
+		return &APIError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			Body:       body.String(),
+		}
+	}
+
+	// Some calls have nothing interesting to say
+	if outParam == nil {
+		return nil
 	}
 
 	decoder := json.NewDecoder(body)
@@ -81,17 +110,23 @@ func (session *AuthorizedSession) GetSessionInfo() (*ring_types.SessionResponse,
 	}
 
 	sessionResponse := &ring_types.SessionResponse{}
-	if err := query(session.client, "POST", uriSession, strings.NewReader(loginForm.Encode()), sessionResponse); err != nil {
+	if err := session.query("POST", uriSession, strings.NewReader(loginForm.Encode()), sessionResponse); err != nil {
 		return nil, err
 	}
 
 	return sessionResponse, nil
 }
 
+// DeleteSession invalidates the session (and the token behind it) server-side.
+// The session can't be used afterwards.
+func (session *AuthorizedSession) DeleteSession() error {
+	return session.query("DELETE", uriSession, nil, nil)
+}
+
 // GetDevices fetches the ring devices in the current API session.
 func (session *AuthorizedSession) GetDevices() (*ring_types.DevicesResponse, error) {
 	devicesRespsonse := &ring_types.DevicesResponse{}
-	if err := query(session.client, "GET", uriRingDevices, nil, devicesRespsonse); err != nil {
+	if err := session.query("GET", uriRingDevices, nil, devicesRespsonse); err != nil {
 		return nil, err
 	}
 
@@ -101,7 +136,7 @@ func (session *AuthorizedSession) GetDevices() (*ring_types.DevicesResponse, err
 // GetDoorBotHealth fetches the health info for a particular id.
 func (session *AuthorizedSession) GetDoorBotHealth(bot *ring_types.DoorBot) (*ring_types.DoorBotHealthResponse, error) {
 	healthResponse := &ring_types.DoorBotHealthResponse{}
-	if err := query(session.client, "GET", fmt.Sprintf(uriDoorbots, bot.Id)+uriHealth, nil, healthResponse); err != nil {
+	if err := session.query("GET", fmt.Sprintf(uriDoorbots, bot.Id)+uriHealth, nil, healthResponse); err != nil {
 		return nil, err
 	}
 
@@ -111,18 +146,93 @@ func (session *AuthorizedSession) GetDoorBotHealth(bot *ring_types.DoorBot) (*ri
 // GetChimeHealth fetches the health info for a particular id.
 func (session *AuthorizedSession) GetChimeHealth(chime *ring_types.Chime) (*ring_types.DoorBotHealthResponse, error) {
 	healthResponse := &ring_types.DoorBotHealthResponse{}
-	if err := query(session.client, "GET", fmt.Sprintf(uriChimes, chime.Id)+uriHealth, nil, healthResponse); err != nil {
+	if err := session.query("GET", fmt.Sprintf(uriChimes, chime.Id)+uriHealth, nil, healthResponse); err != nil {
 		return nil, err
 	}
 
 	return healthResponse, nil
 }
 
+// GetDoorBotHistory fetches the most recent page of dings for a particular id.
 func (session *AuthorizedSession) GetDoorBotHistory(bot *ring_types.DoorBot) ([]ring_types.DoorBotDing, error) {
+	return session.GetDoorBotHistoryPage(bot, HistoryOptions{})
+}
+
+// HistoryOptions controls paging of the doorbot history API. Zero values
+// leave the choice up to the API.
+type HistoryOptions struct {
+	// Limit is the maximum number of dings to return in one page.
+	Limit int
+	// OlderThan only returns dings with an id older than this one. This
+	// is how the API pages backwards through history.
+	OlderThan int64
+}
+
+// GetDoorBotHistoryPage fetches a single page of dings for a particular id, newest first.
+func (session *AuthorizedSession) GetDoorBotHistoryPage(bot *ring_types.DoorBot, opts HistoryOptions) ([]ring_types.DoorBotDing, error) {
+	params := url.Values{}
+	if opts.Limit > 0 {
+		params.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.OlderThan > 0 {
+		params.Set("older_than", strconv.FormatInt(opts.OlderThan, 10))
+	}
+
+	uri := fmt.Sprintf(uriDoorbots, bot.Id) + uriHistory
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+
 	var response []ring_types.DoorBotDing
-	if err := query(session.client, "GET", fmt.Sprintf(uriDoorbots, bot.Id)+uriHistory, nil, &response); err != nil {
+	if err := session.query("GET", uri, nil, &response); err != nil {
 		return nil, err
 	}
 
 	return response, nil
 }
+
+// GetDoorBotHistorySince pages backwards through the dings for a particular id
+// until it reaches one created before `since`. The result is newest first.
+func (session *AuthorizedSession) GetDoorBotHistorySince(bot *ring_types.DoorBot, since time.Time) ([]ring_types.DoorBotDing, error) {
+	var result []ring_types.DoorBotDing
+
+	opts := HistoryOptions{Limit: historyPageSize}
+	for {
+		page, err := session.GetDoorBotHistoryPage(bot, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, ding := range page {
+			ts, err := time.Parse(time.RFC3339, ding.CreatedAt)
+			if err == nil && ts.Before(since) {
+				return result, nil
+			}
+			result = append(result, ding)
+		}
+
+		// A short page means we've reached the beginning of history
+		if len(page) < opts.Limit {
+			return result, nil
+		}
+
+		// Stop rather than loop forever if the API ignores older_than
+		oldest := page[len(page)-1].Id
+		if opts.OlderThan > 0 && oldest >= opts.OlderThan {
+			return nil, fmt.Errorf("History paging didn't move past ding %d", opts.OlderThan)
+		}
+		opts.OlderThan = oldest
+	}
+}
+
+// CheckConnectivity verifies that the API endpoint can be reached. Any HTTP
+// response at all is considered success since no authorization is provided.
+func CheckConnectivity(timeout time.Duration) error {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(baseUrl)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,41 @@
+package ringapi
+
+import (
+	"golang.org/x/oauth2"
+	"sync"
+)
+
+// storingTokenSource hands refreshed tokens back to the TokenHandler so they
+// survive a restart.
+type storingTokenSource struct {
+	source  oauth2.TokenSource
+	handler TokenHandler
+
+	lock sync.Mutex
+	last *oauth2.Token
+}
+
+func newStoringTokenSource(token *oauth2.Token, handler TokenHandler) oauth2.TokenSource {
+	return &storingTokenSource{
+		source:  oauthConfig.TokenSource(oauth2.NoContext, token),
+		handler: handler,
+		last:    token,
+	}
+}
+
+// Token implements `oauth2.TokenSource` interface
+func (s *storingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.last == nil || token.AccessToken != s.last.AccessToken {
+		s.handler.StoreToken(token)
+		s.last = token
+	}
+	return token, nil
+}